@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jlgore/nsfwctl/internal/config"
+	"github.com/jlgore/nsfwctl/internal/git"
+	"github.com/jlgore/nsfwctl/internal/history"
+	"github.com/jlgore/nsfwctl/internal/state"
+	"github.com/jlgore/nsfwctl/internal/terraform"
+	"github.com/jlgore/nsfwctl/internal/ui"
+)
+
+// Exit codes of the non-interactive commands
+const (
+	exitOK            = 0
+	exitError         = 1
+	exitUsage         = 2
+	exitPrerequisites = 3
+	exitCancelled     = 130
+)
+
+const usage = `Usage: nsfwctl [global flags] [command]
+
+Without a command, nsfwctl starts the interactive TUI.
+
+Global flags:
+  --config <file>                    Use an alternate config file (or set NSFWCTL_CONFIG)
+  --repo-url <url>                   Override repo_url (or set NSFWCTL_REPO_URL)
+  --default-branch <branch>          Override default_branch (or set NSFWCTL_DEFAULT_BRANCH)
+  --terraform-path <path>            Override terraform_path (or set NSFWCTL_TERRAFORM_PATH)
+  --log-file <file>                  Override log_file (or set NSFWCTL_LOG_FILE)
+  --profile <name>                   Use a curriculum profile (or set NSFWCTL_PROFILE)
+  --offline                          Work from the local clone without fetching (or set NSFWCTL_OFFLINE)
+
+Profiles are named entries under "profiles" in the config file, each with its
+own repo_url, default_branch, terraform settings and clone_dir. The TUI asks
+for a profile when profiles exist and none is selected. While a profile is
+selected, config set saves those settings into it.
+
+Local curricula: repo_url can be a local path or a file:// URL. A git
+repository (bare or not) is cloned as usual. A plain directory is imported on
+every fetch: its top-level files form the default branch and each subfolder
+becomes a stage branch of the same name.
+
+Private repositories: SSH URLs use ssh_key_file (with its passphrase in
+NSFWCTL_SSH_KEY_PASSPHRASE) or the SSH agent, checked against known_hosts_file.
+HTTPS URLs use the token in NSFWCTL_GIT_TOKEN (or the variable named by
+token_env), then git's credential helper if credential_helper is true, then
+~/.netrc.
+
+Every setting can be overridden with an NSFWCTL_<KEY> environment variable.
+Flags take precedence over the environment, which takes precedence over the
+config file.
+
+Commands:
+  stages list                        List the stages of the curriculum
+  slides <branch>                    Print the slides of a stage
+  dev <dir>                          Show the slides of a local stage folder,
+                                     reloading them whenever they change
+  plan <branch>                      Show what deploying a stage would change
+  apply <branch> [--auto-approve]    Deploy a stage
+        [--ignore-prerequisites]
+  destroy <branch> [--auto-approve]  Tear a stage down
+  history                            Print the deployment history
+  config get [key]                   Print configuration settings
+  config set <key> <value>           Change a configuration setting
+  help                               Show this help
+
+Listing and deployment commands accept --output json to print machine-readable
+results on stdout. Terraform's own output always goes to stderr.
+`
+
+// usageError reports a malformed command line
+type usageError struct{ msg string }
+
+func (e usageError) Error() string { return e.msg }
+
+// prerequisitesError reports stages that have to be deployed first
+type prerequisitesError struct {
+	branch  string
+	missing []string
+}
+
+func (e prerequisitesError) Error() string {
+	return fmt.Sprintf("%s requires stages that aren't deployed: %s (deploy them first or pass --ignore-prerequisites)",
+		e.branch, strings.Join(e.missing, ", "))
+}
+
+// runCommand runs a non-interactive subcommand and returns the process exit code
+func runCommand(args []string) int {
+	// Commands that talk to the network or run terraform stop when interrupted; the local
+	// ones are left to the default handling, so Ctrl+C still ends them
+	ctx := context.Background()
+	switch args[0] {
+	case "stages", "slides", "plan", "apply", "destroy":
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+	}
+
+	var err error
+	switch args[0] {
+	case "stages":
+		err = stagesCommand(ctx, args[1:])
+	case "slides":
+		err = slidesCommand(ctx, args[1:])
+	case "dev":
+		err = devCommand(args[1:])
+	case "plan":
+		err = planCommand(ctx, args[1:])
+	case "apply":
+		err = applyCommand(ctx, args[1:])
+	case "destroy":
+		err = destroyCommand(ctx, args[1:])
+	case "history":
+		err = historyCommand(args[1:])
+	case "config":
+		err = configCommand(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return exitOK
+	default:
+		err = usageError{fmt.Sprintf("unknown command %q", args[0])}
+	}
+
+	return exitCode(ctx, err)
+}
+
+func exitCode(ctx context.Context, err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if ctx.Err() != nil {
+		log.Printf("Command cancelled: %v", err)
+		fmt.Fprintln(os.Stderr, "Cancelled.")
+		return exitCancelled
+	}
+
+	log.Printf("Command failed: %v", err)
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	out := errorOutput{Error: err.Error(), ExitCode: exitError}
+	switch err := err.(type) {
+	case usageError:
+		fmt.Fprintln(os.Stderr, "Run 'nsfwctl help' for usage.")
+		out.ExitCode = exitUsage
+	case prerequisitesError:
+		out.ExitCode = exitPrerequisites
+		out.Missing = err.missing
+	}
+	if jsonOutput() {
+		writeJSON(out)
+	}
+	return out.ExitCode
+}
+
+// parseArgs parses flags wherever they appear on the command line and returns the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	if fs.Lookup("output") == nil {
+		fs.StringVar(&outputFormat, "output", outputText, "output format: text or json")
+	}
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, usageError{fmt.Sprintf("%s: %v", fs.Name(), err)}
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if outputFormat != outputText && outputFormat != outputJSON {
+		return nil, usageError{fmt.Sprintf("unknown output format %q (use text or json)", outputFormat)}
+	}
+	return positional, nil
+}
+
+// branchArg parses a command line taking a single branch name
+func branchArg(fs *flag.FlagSet, args []string) (string, error) {
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return "", err
+	}
+	if len(positional) != 1 {
+		return "", usageError{fmt.Sprintf("%s takes exactly one branch name", fs.Name())}
+	}
+	return positional[0], nil
+}
+
+func ensureRepo(ctx context.Context) (string, error) {
+	ui.ApplySettings()
+	cloneDir, err := config.CloneDir()
+	if err != nil {
+		return "", err
+	}
+	repoPath, err := git.EnsureNsfwctlRepo(ctx, config.CurrentConfig.RepoURL, config.CurrentConfig.DefaultBranch, cloneDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to ensure repository: %v", err)
+	}
+	if banner := git.OfflineBanner(repoPath); banner != "" {
+		fmt.Fprintf(humanOutput(), "Working %s: %s\n", banner, git.OfflineReason())
+	}
+	return repoPath, nil
+}
+
+func stagesCommand(ctx context.Context, args []string) error {
+	positional, err := parseArgs(flag.NewFlagSet("stages", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || positional[0] != "list" {
+		return usageError{"usage: nsfwctl stages list [--output json]"}
+	}
+
+	repoPath, err := ensureRepo(ctx)
+	if err != nil {
+		return err
+	}
+	branches, err := git.FetchBranchesWithDescriptions(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+	deployed, err := state.Deployed()
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		out := stagesOutput{Stages: []stageOutput{}}
+		for _, b := range branches {
+			_, isDeployed := deployed[b.Name]
+			out.Stages = append(out.Stages, stageOutput{BranchInfo: b, Deployed: isDeployed})
+		}
+		return writeJSON(out)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORDER\tBRANCH\tTITLE\tDIFFICULTY\tCOST\tDEPLOYED")
+	for _, b := range branches {
+		order, title, difficulty, cost := "-", "-", "-", "-"
+		if m := b.Manifest; m != nil {
+			order = fmt.Sprint(m.Order)
+			title = valueOr(m.Title, "-")
+			difficulty = valueOr(m.Difficulty, "-")
+			cost = valueOr(m.EstimatedCost, "-")
+		}
+		_, isDeployed := deployed[b.Name]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\n", order, b.Name, title, difficulty, cost, isDeployed)
+	}
+	return tw.Flush()
+}
+
+func slidesCommand(ctx context.Context, args []string) error {
+	branch, err := branchArg(flag.NewFlagSet("slides", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	repoPath, err := ensureRepo(ctx)
+	if err != nil {
+		return err
+	}
+	content, err := git.FetchSlides(ctx, repoPath, branch)
+	if err != nil {
+		return err
+	}
+	fmt.Print(content)
+	return nil
+}
+
+func devCommand(args []string) error {
+	positional, err := parseArgs(flag.NewFlagSet("dev", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError{"dev takes exactly one stage folder"}
+	}
+	return ui.RunDev(positional[0])
+}
+
+func planCommand(ctx context.Context, args []string) error {
+	branch, err := branchArg(flag.NewFlagSet("plan", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	repoPath, err := ensureRepo(ctx)
+	if err != nil {
+		return err
+	}
+	stagePath, err := prepareStage(ctx, repoPath, branch)
+	if err != nil {
+		return err
+	}
+	summary, err := planStage(ctx, branch, stagePath, false)
+	if err != nil {
+		return err
+	}
+	if jsonOutput() {
+		return writeJSON(planOutput{Branch: branch, Operation: "plan", Plan: newPlanJSON(summary)})
+	}
+	summary.WriteText(os.Stdout)
+	return nil
+}
+
+func applyCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	autoApprove := fs.Bool("auto-approve", false, "apply without asking for confirmation")
+	ignorePrereqs := fs.Bool("ignore-prerequisites", false, "apply even if prerequisite stages aren't deployed")
+	branch, err := branchArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	repoPath, err := ensureRepo(ctx)
+	if err != nil {
+		return err
+	}
+	if !*ignorePrereqs {
+		if err := checkPrerequisites(ctx, repoPath, branch); err != nil {
+			return err
+		}
+	}
+
+	stagePath, err := prepareStage(ctx, repoPath, branch)
+	if err != nil {
+		return err
+	}
+	var (
+		summary *terraform.PlanSummary
+		entry   history.Entry
+	)
+	for {
+		summary, err = planStage(ctx, branch, stagePath, false)
+		if err != nil {
+			return err
+		}
+		summary.WriteText(humanOutput())
+
+		if !*autoApprove {
+			if !confirm(ctx, fmt.Sprintf("Apply these changes to %s? Only 'yes' will be accepted: ", branch), "yes") {
+				return fmt.Errorf("apply of %s cancelled", branch)
+			}
+		}
+
+		started := time.Now()
+		_, err = terraform.ApplyTerraform(ctx, stagePath, summary.PlanFile, os.Stderr)
+		entry = record(ctx, "apply", branch, stagePath, started, summary, err)
+		if err != terraform.ErrStalePlan {
+			break
+		}
+		fmt.Fprintln(os.Stderr, "The plan is stale: the state changed since it was made. Planning again.")
+	}
+	if err != nil {
+		return err
+	}
+	if err := state.MarkDeployed(branch); err != nil {
+		log.Printf("Error recording deployment of %s: %v", branch, err)
+	}
+	if jsonOutput() {
+		return writeJSON(resultOutput{Branch: branch, Operation: "apply", Plan: newPlanJSON(summary), Result: newEntryJSON(entry)})
+	}
+	fmt.Printf("Branch %s deployed successfully\n", branch)
+	return nil
+}
+
+func destroyCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("destroy", flag.ContinueOnError)
+	autoApprove := fs.Bool("auto-approve", false, "destroy without asking for confirmation")
+	branch, err := branchArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	repoPath, err := ensureRepo(ctx)
+	if err != nil {
+		return err
+	}
+	stagePath, err := prepareStage(ctx, repoPath, branch)
+	if err != nil {
+		return err
+	}
+	var (
+		summary *terraform.PlanSummary
+		entry   history.Entry
+	)
+	for {
+		summary, err = planStage(ctx, branch, stagePath, true)
+		if err != nil {
+			return err
+		}
+		summary.WriteText(humanOutput())
+
+		if !*autoApprove {
+			if !confirm(ctx, fmt.Sprintf("Type the branch name (%s) to confirm teardown: ", branch), branch) {
+				return fmt.Errorf("teardown of %s cancelled", branch)
+			}
+		}
+
+		started := time.Now()
+		_, err = terraform.DestroyTerraform(ctx, stagePath, summary.PlanFile, os.Stderr)
+		entry = record(ctx, "destroy", branch, stagePath, started, summary, err)
+		if err != terraform.ErrStalePlan {
+			break
+		}
+		fmt.Fprintln(os.Stderr, "The plan is stale: the state changed since it was made. Planning again.")
+	}
+	if err != nil {
+		return err
+	}
+	if err := state.MarkDestroyed(branch); err != nil {
+		log.Printf("Error recording teardown of %s: %v", branch, err)
+	}
+	if jsonOutput() {
+		return writeJSON(resultOutput{Branch: branch, Operation: "destroy", Plan: newPlanJSON(summary), Result: newEntryJSON(entry)})
+	}
+	fmt.Printf("Branch %s torn down successfully\n", branch)
+	return nil
+}
+
+func historyCommand(args []string) error {
+	positional, err := parseArgs(flag.NewFlagSet("history", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError{"usage: nsfwctl history [--output json]"}
+	}
+
+	entries, err := history.Load()
+	if err != nil {
+		return err
+	}
+	if jsonOutput() {
+		out := historyOutput{Entries: []entryJSON{}}
+		for _, entry := range entries {
+			out.Entries = append(out.Entries, newEntryJSON(entry))
+		}
+		return writeJSON(out)
+	}
+	if len(entries) == 0 {
+		fmt.Println("Nothing has been deployed yet.")
+		return nil
+	}
+	for _, entry := range entries {
+		fmt.Println(entry)
+	}
+	return nil
+}
+
+func configCommand(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("config", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) == 1 && args[0] == "get":
+		if jsonOutput() {
+			return writeJSON(config.CurrentConfig)
+		}
+		for _, key := range config.Keys() {
+			value, _ := config.Get(key)
+			fmt.Printf("%s = %s\n", key, value)
+		}
+		return nil
+	case len(args) == 2 && args[0] == "get":
+		value, err := config.Get(args[1])
+		if err != nil {
+			return err
+		}
+		if jsonOutput() {
+			return writeJSON(configValueOutput{Key: args[1], Value: value})
+		}
+		fmt.Println(value)
+		return nil
+	case len(args) == 3 && args[0] == "set":
+		// Parse the value the way the setting is stored, resolving relative paths
+		var parsed config.Config
+		if err := parsed.Set(args[1], args[2]); err != nil {
+			return err
+		}
+		value, err := parsed.Get(args[1])
+		if err != nil {
+			return err
+		}
+
+		// Saved to the selected profile, without flag and environment overrides
+		_, err = config.UpdateSettings(config.CurrentConfig.Profile, map[string]string{args[1]: value})
+		if verr, ok := err.(*config.ValidationError); ok {
+			if problems := verr.For(args[1]); len(problems) > 0 {
+				return usageError{fmt.Sprintf("invalid value for %s", problems[0])}
+			}
+		}
+		return err
+	}
+	return usageError{"usage: nsfwctl config get [key] | nsfwctl config set <key> <value>"}
+}
+
+// prepareStage checks a stage out in its worktree and initializes terraform there
+func prepareStage(ctx context.Context, repoPath, branch string) (string, error) {
+	stagesDir, err := config.StagesDir()
+	if err != nil {
+		return "", err
+	}
+	stagePath, err := git.EnsureStageWorktree(repoPath, stagesDir, branch)
+	if err != nil {
+		return "", err
+	}
+
+	started := time.Now()
+	_, err = terraform.InitTerraform(ctx, stagePath, os.Stderr)
+	record(ctx, "init", branch, stagePath, started, nil, err)
+	if err != nil {
+		return "", err
+	}
+	return stagePath, nil
+}
+
+func planStage(ctx context.Context, branch, stagePath string, destroy bool) (*terraform.PlanSummary, error) {
+	started := time.Now()
+	if destroy {
+		summary, err := terraform.PlanDestroyTerraform(ctx, stagePath, os.Stderr)
+		record(ctx, "plan -destroy", branch, stagePath, started, summary, err)
+		return summary, err
+	}
+	summary, err := terraform.PlanTerraform(ctx, stagePath, os.Stderr)
+	record(ctx, "plan", branch, stagePath, started, summary, err)
+	return summary, err
+}
+
+func checkPrerequisites(ctx context.Context, repoPath, branch string) error {
+	branches, err := git.FetchBranchesWithDescriptions(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+	chain, err := git.PrerequisiteChain(branches, branch)
+	if err != nil {
+		return err
+	}
+	deployed, err := state.Deployed()
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, prereq := range chain {
+		if _, ok := deployed[prereq]; !ok {
+			missing = append(missing, prereq)
+		}
+	}
+	if len(missing) > 0 {
+		return prerequisitesError{branch: branch, missing: missing}
+	}
+	return nil
+}
+
+// record adds a finished terraform operation to the deployment ledger and returns the recorded entry
+func record(ctx context.Context, operation, branch, stagePath string, started time.Time, summary *terraform.PlanSummary, err error) history.Entry {
+	return history.RecordOperation(operation, branch, stagePath, started, summary, err, err != nil && ctx.Err() != nil)
+}
+
+// confirm prompts on stderr and reports whether the answer read from stdin equals want. It
+// gives up without waiting for the answer when ctx is done.
+func confirm(ctx context.Context, prompt, want string) bool {
+	fmt.Fprint(os.Stderr, prompt)
+	answers := make(chan string, 1)
+	go func() {
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && answer == "" {
+			close(answers)
+			return
+		}
+		answers <- answer
+	}()
+
+	select {
+	case answer, ok := <-answers:
+		return ok && strings.TrimSpace(answer) == want
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return false
+	}
+}
+
+func valueOr(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"strconv"
 
 	"github.com/jlgore/nsfwctl/internal/config"
 	"github.com/jlgore/nsfwctl/internal/git"
@@ -14,26 +16,103 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 )
 
+// Flags overriding config settings, keyed by config key
+var configFlags = map[string]string{
+	"repo_url":       "repo-url",
+	"default_branch": "default-branch",
+	"terraform_path": "terraform-path",
+	"log_file":       "log-file",
+	"profile":        "profile",
+}
+
 func main() {
+	configPath := flag.String("config", "", "path to an alternate config file")
+	flagValues := make(map[string]*string)
+	for key, name := range configFlags {
+		flagValues[key] = flag.String(name, "", fmt.Sprintf("override the %s setting", key))
+	}
+	offline := flag.Bool("offline", false, "work from the local clone without fetching")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+
+	overrides := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		for key, name := range configFlags {
+			if f.Name == name {
+				overrides[key] = *flagValues[key]
+			}
+		}
+		if f.Name == "offline" {
+			overrides["offline"] = strconv.FormatBool(*offline)
+		}
+	})
+
 	// Initialize configuration
-	if err := config.Init(); err != nil {
+	if err := config.Init(*configPath, overrides); err != nil {
 		log.Fatalf("Failed to initialize config: %v", err)
 	}
 
+	// The config command stays usable with an invalid config so it can be fixed, and dev
+	// mode only reads a local folder
+	if flag.Arg(0) != "config" && flag.Arg(0) != "dev" {
+		if err := config.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\nFix the settings in %s or with nsfwctl config set <key> <value>.\n", err, config.ConfigPath)
+			os.Exit(exitUsage)
+		}
+	}
+
 	// Setup logging
 	logFile, err := setupLogging()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error setting up logging: %v\n", err)
 		os.Exit(1)
 	}
-	defer logFile.Close()
+
+	// Any arguments select a non-interactive subcommand instead of the TUI
+	if flag.NArg() > 0 {
+		code := runCommand(flag.Args())
+		logFile.Close()
+		os.Exit(code)
+	}
+
+	code := runTUI()
+	logFile.Close()
+	os.Exit(code)
+}
+
+func runTUI() int {
+	// Let the user choose a curriculum if profiles exist and none was selected
+	if config.CurrentConfig.Profile == "" && len(config.CurrentConfig.Profiles) > 0 {
+		name, ok, err := ui.PickProfile()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitError
+		}
+		if !ok {
+			return exitOK
+		}
+		if err := config.SelectProfile(name); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitError
+		}
+		log.Printf("Using profile %q", name)
+	}
+
+	ui.ApplySettings()
 
 	// Ensure the repository exists and is up to date
-	repoPath, err := git.EnsureNsfwctlRepo(config.CurrentConfig.RepoURL, config.CurrentConfig.DefaultBranch)
+	cloneDir, err := config.CloneDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitError
+	}
+	repoPath, err := git.EnsureNsfwctlRepo(context.Background(), config.CurrentConfig.RepoURL, config.CurrentConfig.DefaultBranch, cloneDir)
 	if err != nil {
 		log.Printf("Failed to ensure repository: %v", err)
 		fmt.Fprintf(os.Stderr, "Failed to ensure repository: %v\n", err)
-		os.Exit(1)
+		return exitError
 	}
 
 	fmt.Printf("Terraform repository is located at: %s\n", repoPath)
@@ -41,15 +120,38 @@ func main() {
 	// Initialize the UI model
 	initialState := ui.NewModel(repoPath)
 
-	go git.BackgroundFetch(repoPath) // Start background fetch
-
-	// Run the application
-	p := tea.NewProgram(initialState, tea.WithAltScreen())
+	// Run the application, fetching in the background until it exits. The fetch follows
+	// the curriculum when the settings move it to another clone.
+	var p *tea.Program
+	stopFetch := func() {}
+	startFetch := func(repoPath string) {
+		stopFetch()
+		repo, err := git.OpenRepository(repoPath)
+		if err != nil {
+			log.Printf("Not fetching in the background: %v", err)
+			stopFetch = func() {}
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		stopFetch = cancel
+		go repo.BackgroundFetch(ctx, func(changes git.RefChanges) {
+			p.Send(ui.CurriculumUpdatedMsg{RepoPath: repoPath, Changes: changes})
+		})
+	}
+	p = tea.NewProgram(initialState, tea.WithAltScreen(), tea.WithFilter(func(_ tea.Model, msg tea.Msg) tea.Msg {
+		if msg, ok := msg.(ui.RepoChangedMsg); ok {
+			startFetch(msg.RepoPath)
+		}
+		return msg
+	}))
+	startFetch(repoPath)
+	defer func() { stopFetch() }()
 	if _, err := p.Run(); err != nil {
 		log.Printf("Error running program: %v", err)
 		fmt.Fprintf(os.Stderr, "Error running program: %v\n", err)
-		os.Exit(1)
+		return exitError
 	}
+	return exitOK
 }
 
 func setupLogging() (*os.File, error) {
@@ -62,12 +164,7 @@ func setupLogging() (*os.File, error) {
 		return nil, fmt.Errorf("error creating app directory: %v", err)
 	}
 
-	logPath := config.CurrentConfig.LogFile
-	if !filepath.IsAbs(logPath) {
-		logPath = filepath.Join(appDir, logPath)
-	}
-
-	logFile, err := os.Create(logPath)
+	logFile, err := os.Create(config.LogFilePath(config.CurrentConfig.LogFile))
 	if err != nil {
 		return nil, fmt.Errorf("error creating log file: %v", err)
 	}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jlgore/nsfwctl/internal/git"
+	"github.com/jlgore/nsfwctl/internal/history"
+	"github.com/jlgore/nsfwctl/internal/terraform"
+)
+
+// Output formats selected with --output
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var outputFormat = outputText
+
+func jsonOutput() bool {
+	return outputFormat == outputJSON
+}
+
+// humanOutput is where human-readable progress goes: stdout normally, stderr when stdout carries JSON
+func humanOutput() io.Writer {
+	if jsonOutput() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+func writeJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// The JSON documents printed with --output json. Fields are only ever added to these,
+// never renamed or removed, so dashboards can rely on them.
+
+type stageOutput struct {
+	git.BranchInfo
+	Deployed bool `json:"deployed"`
+}
+
+type stagesOutput struct {
+	Stages []stageOutput `json:"stages"`
+}
+
+type planJSON struct {
+	Counts  map[string]int             `json:"counts"`
+	Changes []terraform.ResourceChange `json:"changes"`
+}
+
+func newPlanJSON(summary *terraform.PlanSummary) planJSON {
+	changes := summary.Changes
+	if changes == nil {
+		changes = []terraform.ResourceChange{}
+	}
+	return planJSON{Counts: summary.Counts(), Changes: changes}
+}
+
+type planOutput struct {
+	Branch    string   `json:"branch"`
+	Operation string   `json:"operation"`
+	Plan      planJSON `json:"plan"`
+}
+
+// entryJSON is a ledger entry with its duration in seconds rather than in the ledger's
+// nanoseconds
+type entryJSON struct {
+	Time            time.Time      `json:"time"`
+	Operation       string         `json:"operation"`
+	Branch          string         `json:"branch"`
+	Commit          string         `json:"commit,omitempty"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Resources       map[string]int `json:"resources,omitempty"`
+	Outcome         string         `json:"outcome"`
+	Error           string         `json:"error,omitempty"`
+}
+
+func newEntryJSON(e history.Entry) entryJSON {
+	return entryJSON{
+		Time:            e.Time,
+		Operation:       e.Operation,
+		Branch:          e.Branch,
+		Commit:          e.Commit,
+		DurationSeconds: e.Duration.Seconds(),
+		Resources:       e.Resources,
+		Outcome:         e.Outcome,
+		Error:           e.Error,
+	}
+}
+
+type resultOutput struct {
+	Branch    string    `json:"branch"`
+	Operation string    `json:"operation"`
+	Plan      planJSON  `json:"plan"`
+	Result    entryJSON `json:"result"`
+}
+
+type historyOutput struct {
+	Entries []entryJSON `json:"entries"`
+}
+
+type configValueOutput struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type errorOutput struct {
+	Error    string   `json:"error"`
+	ExitCode int      `json:"exit_code"`
+	Missing  []string `json:"missing_prerequisites,omitempty"`
+}
@@ -1,23 +1,62 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jlgore/nsfwctl/pkg/utils"
 )
 
 // Config holds the application configuration
 type Config struct {
-	RepoURL       string `json:"repo_url"`
-	DefaultBranch string `json:"default_branch"`
-	TerraformPath string `json:"terraform_path"`
-	LogFile       string `json:"log_file"`
+	SchemaVersion    int    `json:"schema_version"`
+	RepoURL          string `json:"repo_url"`
+	DefaultBranch    string `json:"default_branch"`
+	TerraformPath    string `json:"terraform_path"`
+	TerraformVersion string `json:"terraform_version,omitempty"` // Empty installs terraform.DefaultTerraformVersion
+	TerraformArchive string `json:"terraform_archive,omitempty"`
+	Offline          bool   `json:"offline"` // Work from the local clone and never download terraform
+	LogFile          string `json:"log_file"`
+	CloneDir         string `json:"clone_dir,omitempty"`
+
+	// Authentication for private repositories. SSH URLs use the key file or the SSH agent;
+	// HTTPS URLs use the token in the token_env variable, the git credential helper, or ~/.netrc.
+	SSHKeyFile       string `json:"ssh_key_file,omitempty"`
+	KnownHostsFile   string `json:"known_hosts_file,omitempty"`
+	TokenEnv         string `json:"token_env,omitempty"`
+	CredentialHelper bool   `json:"credential_helper,omitempty"`
+
+	// Profile names the active entry of Profiles; empty uses the settings above
+	Profile  string             `json:"profile,omitempty"`
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+}
+
+// Profile holds the settings of one curriculum. Empty fields fall back to the top-level settings.
+type Profile struct {
+	RepoURL          string `json:"repo_url,omitempty"`
+	DefaultBranch    string `json:"default_branch,omitempty"`
+	TerraformPath    string `json:"terraform_path,omitempty"`
+	TerraformVersion string `json:"terraform_version,omitempty"`
+	TerraformArchive string `json:"terraform_archive,omitempty"`
+	CloneDir         string `json:"clone_dir,omitempty"`
+	SSHKeyFile       string `json:"ssh_key_file,omitempty"`
+	KnownHostsFile   string `json:"known_hosts_file,omitempty"`
+	TokenEnv         string `json:"token_env,omitempty"`
+	CredentialHelper bool   `json:"credential_helper,omitempty"`
 }
 
 var (
 	// DefaultConfig holds the default configuration
 	DefaultConfig = Config{
+		SchemaVersion: CurrentSchemaVersion,
 		RepoURL:       "https://github.com/jlgore/nsfw-infra",
 		DefaultBranch: "main",
 		TerraformPath: "terraform",
@@ -26,52 +65,180 @@ var (
 
 	// CurrentConfig holds the current active configuration
 	CurrentConfig Config
+
+	// ConfigPath is the config file the current configuration was loaded from
+	ConfigPath string
+
+	// configOverrides are the settings passed to Init, reapplied when switching profiles
+	configOverrides map[string]string
 )
 
+// EnvPrefix is the prefix of environment variables overriding config settings
+const EnvPrefix = "NSFWCTL_"
+
 // LoadConfig loads the configuration from a file
 func LoadConfig(configPath string) error {
+	cfg, err := ReadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	CurrentConfig = cfg
+	return nil
+}
+
+// ReadConfig returns DefaultConfig overlaid with the settings in a config file, if it exists.
+// Files with an older schema version are upgraded in place after a backup is made.
+func ReadConfig(configPath string) (Config, error) {
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return DefaultConfig, err
+	}
+	defer unlock()
+	return readConfig(configPath)
+}
+
+// readConfig is ReadConfig for callers holding the config lock
+func readConfig(configPath string) (Config, error) {
 	// Start with default config
-	CurrentConfig = DefaultConfig
+	cfg := DefaultConfig
 
 	// If config file exists, load it
-	if _, err := os.Stat(configPath); err == nil {
-		file, err := os.Open(configPath)
-		if err != nil {
-			return fmt.Errorf("error opening config file: %v", err)
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("error opening config file: %v", err)
+	}
+
+	migrated, version, err := migrateConfig(configPath, data)
+	if err != nil {
+		return cfg, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(migrated))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		if strings.HasPrefix(err.Error(), "json: unknown field") {
+			return cfg, fmt.Errorf("error decoding config file %s: %v (valid keys: %s)", configPath, err, strings.Join(Keys(), ", "))
 		}
-		defer file.Close()
+		return cfg, fmt.Errorf("error decoding config file %s: %v", configPath, err)
+	}
 
-		decoder := json.NewDecoder(file)
-		if err := decoder.Decode(&CurrentConfig); err != nil {
-			return fmt.Errorf("error decoding config file: %v", err)
+	if version < CurrentSchemaVersion {
+		if _, err := backupConfig(configPath, data, version); err != nil {
+			return cfg, err
 		}
+		if err := writeConfig(configPath, cfg); err != nil {
+			return cfg, err
+		}
+		log.Printf("Upgraded config file %s from schema version %d to %d", configPath, version, CurrentSchemaVersion)
 	}
 
-	return nil
+	return cfg, nil
 }
 
 // SaveConfig saves the current configuration to a file
 func SaveConfig(configPath string) error {
-	dir := filepath.Dir(configPath)
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeConfig(configPath, CurrentConfig)
+}
+
+// ModifyConfig reads a config file, lets modify change it and writes it back, holding the
+// config lock throughout so concurrent nsfwctl instances don't overwrite each other's changes.
+// Nothing is written if modify returns an error.
+func ModifyConfig(configPath string, modify func(cfg *Config) error) error {
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if err := modify(&cfg); err != nil {
+		return err
+	}
+	return writeConfig(configPath, cfg)
+}
+
+// writeConfig atomically replaces the config file: the settings are written and synced to a
+// temporary file, readable only by the user, which is then renamed over the config file
+func writeConfig(configPath string, cfg Config) error {
+	cfg.SchemaVersion = CurrentSchemaVersion
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding config file: %v", err)
+	}
+	return writeFileAtomic(configPath, append(data, '\n'))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("error creating config directory: %v", err)
 	}
 
-	file, err := os.Create(configPath)
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
 	if err != nil {
 		return fmt.Errorf("error creating config file: %v", err)
 	}
-	defer file.Close()
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath) // No-op once renamed
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(CurrentConfig); err != nil {
-		return fmt.Errorf("error encoding config file: %v", err)
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return fmt.Errorf("error setting config file permissions: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing config file: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("error syncing config file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing config file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error replacing config file: %v", err)
 	}
 
+	// Make the rename itself durable; not supported everywhere, so errors are ignored
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
 	return nil
 }
 
+// lockConfig takes an exclusive lock on <configPath>.lock, waiting for other nsfwctl
+// instances to release it. The returned function releases the lock.
+func lockConfig(configPath string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return nil, fmt.Errorf("error creating config directory: %v", err)
+	}
+	file, err := os.OpenFile(configPath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config lock: %v", err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error locking config file: %v", err)
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
 // GetConfigFilePath returns the path to the config file
 func GetConfigFilePath() (string, error) {
 	homeDir, err := os.UserHomeDir()
@@ -82,23 +249,438 @@ func GetConfigFilePath() (string, error) {
 	return filepath.Join(homeDir, ".nsfwctl", "config.json"), nil
 }
 
-// Init initializes the configuration
-func Init() error {
-	configPath, err := GetConfigFilePath()
+// Init initializes the configuration. Settings are layered with the precedence
+// overrides > NSFWCTL_* environment variables > profile > config file > DefaultConfig.
+// configPath selects an alternate config file; if empty, NSFWCTL_CONFIG or
+// ~/.nsfwctl/config.json is used. overrides maps config keys to values, e.g. from flags;
+// the "profile" key selects the profile.
+func Init(configPath string, overrides map[string]string) error {
+	if configPath == "" {
+		configPath = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if configPath == "" {
+		defaultPath, err := GetConfigFilePath()
+		if err != nil {
+			return err
+		}
+		configPath = defaultPath
+	}
+	ConfigPath = configPath
+	configOverrides = overrides
+
+	if err := createConfig(configPath); err != nil {
+		return err
+	}
+
+	// The profile comes from the overrides, then NSFWCTL_PROFILE, then the config file
+	profile, ok := overrides["profile"]
+	if !ok {
+		profile, ok = os.LookupEnv(EnvPrefix + "PROFILE")
+	}
+	if !ok {
+		if err := LoadConfig(configPath); err != nil {
+			return err
+		}
+		profile = CurrentConfig.Profile
+	}
+	return load(profile)
+}
+
+// createConfig writes a config file with the default settings if there is none yet. The
+// check is made holding the config lock, so a file another instance is saving at the same
+// time isn't overwritten with defaults.
+func createConfig(configPath string) error {
+	unlock, err := lockConfig(configPath)
 	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		return nil
+	}
+	return writeConfig(configPath, DefaultConfig)
+}
 
-	if err := LoadConfig(configPath); err != nil {
+// SelectProfile reloads the configuration with a different profile, keeping environment
+// and flag overrides. An empty name selects the top-level settings.
+func SelectProfile(name string) error {
+	return load(name)
+}
+
+// ProfileNames returns the names of the configured profiles in sorted order
+func ProfileNames() []string {
+	return sortedProfileNames(CurrentConfig.Profiles)
+}
+
+func sortedProfileNames(profiles map[string]Profile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// load layers the config file, a profile, the environment and the overrides into CurrentConfig
+func load(profile string) error {
+	cfg, err := ReadConfig(ConfigPath)
+	if err != nil {
 		return err
 	}
+	if cfg, err = resolve(cfg, profile); err != nil {
+		return err
+	}
+	CurrentConfig = cfg
+	return nil
+}
+
+// resolve overlays the named profile, NSFWCTL_* environment variables and the overrides
+// passed to Init onto settings read from the config file
+func resolve(cfg Config, profile string) (Config, error) {
+	if err := cfg.applyProfile(profile); err != nil {
+		return cfg, err
+	}
+	cfg.Profile = profile
+
+	if err := cfg.applyEnvironment(); err != nil {
+		return cfg, err
+	}
+
+	for key, value := range configOverrides {
+		if key == "profile" {
+			continue
+		}
+		if err := cfg.Set(key, value); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// applyProfile overlays the non-empty settings of the named profile onto c
+func (c *Config) applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	p, ok := c.Profiles[name]
+	if !ok {
+		if len(c.Profiles) == 0 {
+			return fmt.Errorf("unknown profile %q: no profiles are configured in %s", name, ConfigPath)
+		}
+		return fmt.Errorf("unknown profile %q (available profiles: %s)", name, strings.Join(sortedProfileNames(c.Profiles), ", "))
+	}
 
-	// If config file doesn't exist, create it with default values
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		if err := SaveConfig(configPath); err != nil {
+	overlay := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	overlay(&c.RepoURL, p.RepoURL)
+	overlay(&c.DefaultBranch, p.DefaultBranch)
+	overlay(&c.TerraformPath, p.TerraformPath)
+	overlay(&c.TerraformVersion, p.TerraformVersion)
+	overlay(&c.TerraformArchive, p.TerraformArchive)
+	overlay(&c.SSHKeyFile, p.SSHKeyFile)
+	overlay(&c.KnownHostsFile, p.KnownHostsFile)
+	overlay(&c.TokenEnv, p.TokenEnv)
+	c.CredentialHelper = c.CredentialHelper || p.CredentialHelper
+	// A profile never shares the top-level clone directory
+	c.CloneDir = p.CloneDir
+	return nil
+}
+
+// applyEnvironment overrides settings from NSFWCTL_<KEY> environment variables, e.g. NSFWCTL_REPO_URL
+func (c *Config) applyEnvironment() error {
+	for _, key := range Keys() {
+		if key == "profile" || managedKey(key) {
+			continue
+		}
+		name := EnvPrefix + strings.ToUpper(key)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := c.Set(key, value); err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultTokenEnv is the environment variable holding an HTTPS token when token_env isn't set
+const DefaultTokenEnv = EnvPrefix + "GIT_TOKEN"
+
+// Token returns the HTTPS token for the curriculum repository from the environment
+func Token() string {
+	name := CurrentConfig.TokenEnv
+	if name == "" {
+		name = DefaultTokenEnv
+	}
+	return os.Getenv(name)
+}
+
+// SSHKeyPassphrase returns the passphrase of ssh_key_file from NSFWCTL_SSH_KEY_PASSPHRASE
+func SSHKeyPassphrase() string {
+	return os.Getenv(EnvPrefix + "SSH_KEY_PASSPHRASE")
+}
+
+// OverrideSource describes what overrides a setting from the config file, if anything:
+// "command line" or the name of the environment variable
+func OverrideSource(key string) string {
+	if _, ok := configOverrides[key]; ok {
+		return "command line"
+	}
+	name := EnvPrefix + strings.ToUpper(key)
+	if _, ok := os.LookupEnv(name); ok && key != "profile" && !managedKey(key) {
+		return name
+	}
+	return ""
+}
+
+// DataDir returns the directory holding the clone, stage worktrees and deployment records
+// of the active profile: ~/.nsfwctl, or ~/.nsfwctl/profiles/<name> for a named profile
+func DataDir() (string, error) {
+	return CurrentConfig.DataDir()
+}
+
+// DataDir is the package-level DataDir for the profile c was resolved with
+func (c Config) DataDir() (string, error) {
+	appDir, err := utils.GetAppDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting app directory: %v", err)
+	}
+	if c.Profile == "" {
+		return appDir, nil
+	}
+	return filepath.Join(appDir, "profiles", c.Profile), nil
+}
+
+// StagesDir returns the directory holding the worktrees of the stages, stages in DataDir
+func StagesDir() (string, error) {
+	dataDir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "stages"), nil
+}
+
+// CloneDir returns the directory the curriculum repository is cloned into,
+// defaulting to infra in DataDir. Relative clone_dir settings are inside ~/.nsfwctl.
+func CloneDir() (string, error) {
+	return CurrentConfig.ClonePath()
+}
+
+// ClonePath is CloneDir for the settings in c
+func (c Config) ClonePath() (string, error) {
+	if c.CloneDir != "" {
+		if filepath.IsAbs(c.CloneDir) {
+			return c.CloneDir, nil
+		}
+		appDir, err := utils.GetAppDir()
+		if err != nil {
+			return "", fmt.Errorf("error getting app directory: %v", err)
+		}
+		return filepath.Join(appDir, c.CloneDir), nil
+	}
+	dataDir, err := c.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "infra"), nil
+}
+
+// Keys returns the names of all configuration settings, as used in config.json
+func Keys() []string {
+	return fieldKeys(reflect.TypeOf(Config{}))
+}
+
+// SettableKeys returns the names of the settings that hold a single value, in config.json order
+func SettableKeys() []string {
+	var keys []string
+	v := reflect.ValueOf(Config{})
+	for i := 0; i < v.NumField(); i++ {
+		if key := jsonName(v.Type().Field(i)); settable(v.Field(i)) && !managedKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Get returns the current value of a configuration setting. Structured settings are returned as JSON.
+func Get(key string) (string, error) {
+	return CurrentConfig.Get(key)
+}
+
+// Set changes a configuration setting in CurrentConfig, parsing value for the setting's type
+func Set(key, value string) error {
+	return CurrentConfig.Set(key, value)
+}
+
+// Get returns the value of a setting. Structured settings are returned as JSON.
+func (c Config) Get(key string) (string, error) {
+	field, err := structField(reflect.ValueOf(&c).Elem(), key)
+	if err != nil {
+		return "", err
+	}
+	if field.Kind() == reflect.Map {
+		data, err := json.Marshal(field.Interface())
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return fmt.Sprint(field.Interface()), nil
+}
+
+// Set changes a setting, parsing value for the setting's type
+func (c *Config) Set(key, value string) error {
+	field, err := structField(reflect.ValueOf(c).Elem(), key)
+	if err != nil {
+		return err
+	}
+	if !settable(field) || managedKey(key) {
+		return fmt.Errorf("config key %s can't be set from the command line", key)
+	}
+	if path, ok := utils.LocalRepoPath(value); ok && key == "repo_url" && strings.HasPrefix(value, ".") {
+		value = path // Relative to where it was given, not to wherever nsfwctl runs next
+	}
+	if err := setField(field, value); err != nil {
+		return fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+	return nil
+}
+
+// EditableSettings returns the settings as stored in the config file, with the active
+// profile applied but without environment or flag overrides
+func EditableSettings() (Config, error) {
+	cfg, err := ReadConfig(ConfigPath)
+	if err != nil {
+		return cfg, err
+	}
+	if err := cfg.applyProfile(CurrentConfig.Profile); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// UpdateSettings validates changed settings and saves them to the config file. While
+// profile is set, settings a profile can hold are saved to that profile. It returns the
+// configuration as it now resolves, leaving CurrentConfig to the caller. Invalid settings
+// are reported as a *ValidationError and nothing is saved.
+func UpdateSettings(profile string, changes map[string]string) (Config, error) {
+	var saved Config
+	err := ModifyConfig(ConfigPath, func(cfg *Config) error {
+		var p Profile
+		if profile != "" {
+			p = cfg.Profiles[profile]
+		}
+
+		var problems []Problem
+		for key, value := range changes {
+			target := reflect.ValueOf(cfg).Elem()
+			if profile != "" && isProfileKey(key) {
+				target = reflect.ValueOf(&p).Elem()
+			}
+			field, err := structField(target, key)
+			if err != nil {
+				return err
+			}
+			if err := setField(field, value); err != nil {
+				problems = append(problems, Problem{Key: key, Message: err.Error()})
+			}
+		}
+		if profile != "" {
+			profiles := make(map[string]Profile, len(cfg.Profiles))
+			for name, existing := range cfg.Profiles {
+				profiles[name] = existing
+			}
+			profiles[profile] = p
+			cfg.Profiles = profiles
+		}
+
+		effective := *cfg
+		if err := effective.applyProfile(profile); err != nil {
 			return err
 		}
+		if err := effective.Validate(); err != nil {
+			problems = append(problems, err.(*ValidationError).Problems...)
+		}
+		if len(problems) > 0 {
+			return &ValidationError{Problems: problems}
+		}
+		saved = *cfg
+		return nil
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	return resolve(saved, profile)
+}
+
+// isProfileKey reports whether a profile can override the setting
+func isProfileKey(key string) bool {
+	for _, k := range fieldKeys(reflect.TypeOf(Profile{})) {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldKeys(t reflect.Type) []string {
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, jsonName(t.Field(i)))
+	}
+	return keys
+}
+
+func structField(v reflect.Value, key string) (reflect.Value, error) {
+	for i := 0; i < v.NumField(); i++ {
+		if jsonName(v.Type().Field(i)) == key {
+			return v.Field(i), nil
+		}
 	}
+	return reflect.Value{}, fmt.Errorf("unknown config key %q (valid keys: %s)", key, strings.Join(Keys(), ", "))
+}
+
+// managedKey reports whether a setting is maintained by nsfwctl or edited in the file only
+func managedKey(key string) bool {
+	return key == "schema_version" || key == "profiles"
+}
 
+func settable(field reflect.Value) bool {
+	switch field.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int:
+		return true
+	}
+	return false
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetInt(int64(n))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Kind())
+	}
 	return nil
 }
+
+func jsonName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// CurrentSchemaVersion is the config file schema written by this version of nsfwctl
+const CurrentSchemaVersion = 2
+
+// migrations upgrade a decoded config file one schema version at a time:
+// migrations[i] turns a version i file into a version i+1 file.
+var migrations = []func(raw map[string]json.RawMessage) error{
+	// 0 → 1: files written before schema_version existed use the same keys
+	func(raw map[string]json.RawMessage) error { return nil },
+	// 1 → 2: adds the optional authentication settings, which nsfwctl versions
+	// that only know version 1 would reject as unknown keys
+	func(raw map[string]json.RawMessage) error { return nil },
+}
+
+// migrateConfig upgrades the contents of a config file to CurrentSchemaVersion. It reports
+// the version the file had, and refuses files written by a newer nsfwctl.
+func migrateConfig(configPath string, data []byte) ([]byte, int, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, fmt.Errorf("error decoding config file %s: %v", configPath, err)
+	}
+
+	version := 0
+	if v, ok := raw["schema_version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return nil, 0, fmt.Errorf("error decoding config file %s: schema_version must be a number", configPath)
+		}
+	}
+	if version > CurrentSchemaVersion {
+		return nil, version, fmt.Errorf("config file %s has schema version %d, but this nsfwctl only understands versions up to %d; upgrade nsfwctl or use another config file with --config", configPath, version, CurrentSchemaVersion)
+	}
+	if version == CurrentSchemaVersion {
+		return data, version, nil
+	}
+
+	for v := version; v < CurrentSchemaVersion; v++ {
+		if err := migrations[v](raw); err != nil {
+			return nil, version, fmt.Errorf("error migrating config file %s from schema version %d: %v", configPath, v, err)
+		}
+	}
+	raw["schema_version"] = json.RawMessage(fmt.Sprint(CurrentSchemaVersion))
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, version, fmt.Errorf("error encoding migrated config: %v", err)
+	}
+	return migrated, version, nil
+}
+
+// backupConfig keeps a copy of a config file before it is upgraded from the given schema version
+func backupConfig(configPath string, data []byte, version int) (string, error) {
+	backupPath := fmt.Sprintf("%s.v%d.bak", configPath, version)
+	if err := writeFileAtomic(backupPath, data); err != nil {
+		return "", fmt.Errorf("error backing up config file: %v", err)
+	}
+	log.Printf("Backed up config file with schema version %d to %s", version, backupPath)
+	return backupPath, nil
+}
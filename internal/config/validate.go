@@ -0,0 +1,236 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+// Problem is a single invalid configuration setting
+type Problem struct {
+	Key     string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Key, p.Message)
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{"invalid configuration:"}
+	for _, p := range e.Problems {
+		lines = append(lines, "  - "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// For returns the problems with the given setting
+func (e *ValidationError) For(key string) []Problem {
+	var problems []Problem
+	for _, p := range e.Problems {
+		if p.Key == key {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// scpURL matches scp-like git URLs such as git@github.com:jlgore/nsfw-infra.git
+var scpURL = regexp.MustCompile(`^[\w.-]+@[\w.-]+:[^/].*$`)
+
+var repoURLSchemes = []string{"https", "http", "ssh", "git", "file"}
+
+// Validate checks the current configuration and returns a *ValidationError
+// describing all problems at once, or nil if the configuration is usable
+func Validate() error {
+	return CurrentConfig.Validate()
+}
+
+// Validate checks the configuration and returns a *ValidationError
+// describing all problems at once, or nil if the configuration is usable
+func (c Config) Validate() error {
+	var problems []Problem
+	add := func(key, format string, args ...interface{}) {
+		problems = append(problems, Problem{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if err := validateRepoURL(c.RepoURL); err != nil {
+		add("repo_url", "%v", err)
+	}
+
+	if c.DefaultBranch == "" {
+		add("default_branch", "must not be empty")
+	} else if !utils.IsValidBranchName(c.DefaultBranch) {
+		add("default_branch", "%q is not a valid git branch name", c.DefaultBranch)
+	}
+
+	// Bare names are looked up in PATH and fall back to installing the pinned version,
+	// but an explicit path must point at the binary
+	if strings.ContainsRune(c.TerraformPath, filepath.Separator) {
+		if err := checkExecutable(c.TerraformPath); err != nil {
+			add("terraform_path", "%v", err)
+		}
+	}
+
+	if c.SSHKeyFile != "" {
+		if err := checkReadable(c.SSHKeyFile); err != nil {
+			add("ssh_key_file", "%v", err)
+		}
+	}
+	if c.KnownHostsFile != "" {
+		if err := checkReadable(c.KnownHostsFile); err != nil {
+			add("known_hosts_file", "%v", err)
+		}
+	}
+
+	if c.LogFile == "" {
+		add("log_file", "must not be empty")
+	} else if err := checkWritable(LogFilePath(c.LogFile)); err != nil {
+		add("log_file", "%v", err)
+	}
+
+	for _, name := range sortedProfileNames(c.Profiles) {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			add("profiles", "%q is not a valid profile name", name)
+		}
+	}
+	if _, ok := c.Profiles[c.Profile]; c.Profile != "" && !ok {
+		add("profile", "unknown profile %q", c.Profile)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// LogFilePath resolves a log_file setting; relative paths are inside ~/.nsfwctl
+func LogFilePath(logFile string) string {
+	if filepath.IsAbs(logFile) {
+		return logFile
+	}
+	appDir, err := utils.GetAppDir()
+	if err != nil {
+		return logFile
+	}
+	return filepath.Join(appDir, logFile)
+}
+
+func validateRepoURL(repoURL string) error {
+	if repoURL == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	if path, ok := utils.LocalRepoPath(repoURL); ok {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%s does not exist", path)
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", path)
+		}
+		return nil
+	}
+	if scpURL.MatchString(repoURL) {
+		return nil
+	}
+
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid URL: %v", repoURL, err)
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("%q has no scheme (expected one of %s, user@host:path or a local path)", repoURL, strings.Join(repoURLSchemes, ", "))
+	}
+	if !knownScheme(u.Scheme) {
+		return fmt.Errorf("unsupported scheme %q (expected one of %s)", u.Scheme, strings.Join(repoURLSchemes, ", "))
+	}
+	if u.Scheme != "file" && u.Host == "" {
+		return fmt.Errorf("%q has no host", repoURL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		return fmt.Errorf("%q has no repository path", repoURL)
+	}
+	return nil
+}
+
+func knownScheme(scheme string) bool {
+	for _, s := range repoURLSchemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s does not exist", path)
+		}
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+func checkReadable(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s does not exist", path)
+		}
+		return fmt.Errorf("%s is not readable: %v", path, err)
+	}
+	return file.Close()
+}
+
+// checkWritable reports whether path can be written, without truncating an existing file
+func checkWritable(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", path)
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %v", path, err)
+		}
+		return file.Close()
+	}
+
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// The app directory is created on startup, other directories are not
+		appDir, _ := utils.GetAppDir()
+		if dir != appDir {
+			return fmt.Errorf("directory %s does not exist", dir)
+		}
+		return nil
+	}
+	file, err := os.CreateTemp(dir, ".nsfwctl-write-check-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %v", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,236 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// AuthOptions describes how to authenticate to a private curriculum repository
+type AuthOptions struct {
+	// SSHKeyFile is a private key for SSH URLs; if empty the SSH agent is used
+	SSHKeyFile string
+	// SSHKeyPassphrase decrypts SSHKeyFile
+	SSHKeyPassphrase string
+	// KnownHostsFile verifies SSH host keys, defaulting to $SSH_KNOWN_HOSTS or ~/.ssh/known_hosts
+	KnownHostsFile string
+	// Token is used as the password for HTTPS URLs
+	Token string
+	// CredentialHelper asks `git credential fill` for HTTPS credentials when there is no token
+	CredentialHelper bool
+}
+
+var (
+	authOptions AuthOptions
+	authMux     sync.Mutex
+)
+
+// SetAuthOptions sets how clones and fetches authenticate. HTTPS URLs use the token, then
+// the credential helper, then ~/.netrc (or $NETRC).
+func SetAuthOptions(opts AuthOptions) {
+	authMux.Lock()
+	defer authMux.Unlock()
+	authOptions = opts
+}
+
+// authMethod returns the credentials to use for repoURL, or nil if none are needed or configured
+func authMethod(repoURL string) (transport.AuthMethod, error) {
+	authMux.Lock()
+	opts := authOptions
+	authMux.Unlock()
+
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL %q: %v", repoURL, err)
+	}
+
+	switch endpoint.Protocol {
+	case "ssh":
+		return sshAuth(endpoint, opts)
+	case "http", "https":
+		return httpAuth(endpoint, opts)
+	}
+	return nil, nil
+}
+
+// originAuth returns the credentials for the origin remote of repo
+func originAuth(repo *git.Repository) (transport.AuthMethod, error) {
+	url, err := originURL(repo)
+	if err != nil || url == "" {
+		return nil, err
+	}
+	return authMethod(url)
+}
+
+func sshAuth(endpoint *transport.Endpoint, opts AuthOptions) (transport.AuthMethod, error) {
+	user := endpoint.User
+	if user == "" {
+		user = "git"
+	}
+
+	var knownHosts []string
+	if opts.KnownHostsFile != "" {
+		knownHosts = append(knownHosts, opts.KnownHostsFile)
+	}
+	hostKeyCallback, err := ssh.NewKnownHostsCallback(knownHosts...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading known hosts (set known_hosts_file to use another file): %v", err)
+	}
+
+	if opts.SSHKeyFile != "" {
+		auth, err := ssh.NewPublicKeysFromFile(user, opts.SSHKeyFile, opts.SSHKeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("error loading SSH key %s: %v", opts.SSHKeyFile, err)
+		}
+		auth.HostKeyCallback = hostKeyCallback
+		return auth, nil
+	}
+
+	auth, err := ssh.NewSSHAgentAuth(user)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the SSH agent (set ssh_key_file to use a key file instead): %v", err)
+	}
+	auth.HostKeyCallback = hostKeyCallback
+	return auth, nil
+}
+
+func httpAuth(endpoint *transport.Endpoint, opts AuthOptions) (transport.AuthMethod, error) {
+	if endpoint.Password != "" {
+		return nil, nil // Credentials in the URL are used as they are
+	}
+
+	if opts.Token != "" {
+		user := endpoint.User
+		if user == "" {
+			user = "git" // GitHub and GitLab ignore the user name for tokens
+		}
+		return &http.BasicAuth{Username: user, Password: opts.Token}, nil
+	}
+
+	if opts.CredentialHelper {
+		user, password, err := credentialFill(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if password != "" {
+			return &http.BasicAuth{Username: user, Password: password}, nil
+		}
+	}
+
+	user, password, err := netrcLookup(endpoint.Host)
+	if err != nil {
+		log.Printf("Error reading netrc: %v", err)
+	}
+	if password != "" {
+		return &http.BasicAuth{Username: user, Password: password}, nil
+	}
+	return nil, nil
+}
+
+// credentialFill asks git's configured credential helpers for the credentials of an endpoint
+func credentialFill(endpoint *transport.Endpoint) (string, string, error) {
+	input := fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\n", endpoint.Protocol, endpoint.Host, strings.TrimPrefix(endpoint.Path, "/"))
+	if endpoint.User != "" {
+		input += fmt.Sprintf("username=%s\n", endpoint.User)
+	}
+
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Stdin = strings.NewReader(input + "\n")
+	// Never prompt on the terminal, the TUI owns it
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("error running git credential fill: %v", err)
+	}
+
+	var user, password string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "username":
+			user = value
+		case "password":
+			password = value
+		}
+	}
+	return user, password, nil
+}
+
+// netrcLookup returns the login and password for host from $NETRC or ~/.netrc,
+// falling back to the default entry
+func netrcLookup(host string) (string, string, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		path = filepath.Join(homeDir, ".netrc")
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var (
+		login, password       string
+		defLogin, defPassword string
+		inDefault, inMatch    bool
+	)
+	fields := strings.Fields(string(data))
+	for i := 0; i < len(fields); i++ {
+		next := func() string {
+			if i+1 < len(fields) {
+				i++
+				return fields[i]
+			}
+			return ""
+		}
+		switch fields[i] {
+		case "machine":
+			if inMatch {
+				return login, password, nil
+			}
+			inMatch, inDefault = next() == host, false
+		case "default":
+			if inMatch {
+				return login, password, nil
+			}
+			inDefault = true
+		case "login":
+			value := next()
+			if inMatch {
+				login = value
+			} else if inDefault {
+				defLogin = value
+			}
+		case "password":
+			value := next()
+			if inMatch {
+				password = value
+			} else if inDefault {
+				defPassword = value
+			}
+		}
+	}
+	if inMatch {
+		return login, password, nil
+	}
+	return defLogin, defPassword, nil
+}
@@ -2,141 +2,146 @@ package git
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/jlgore/nsfwctl/pkg/utils"
 )
 
-var (
-	branchCache     []BranchInfo
-	branchCacheMux  sync.RWMutex
-	lastBranchFetch time.Time
-	lastFetchTime   time.Time
-)
-
-const fetchInterval = 5 * time.Minute
-
-func BackgroundFetch(repoPath string) {
-	go func() {
-		for {
-			time.Sleep(fetchInterval)
-			if time.Since(lastFetchTime) >= fetchInterval {
-				repo, err := git.PlainOpen(repoPath)
-				if err != nil {
-					continue
-				}
-				_ = fetchRepo(repo) // Ignore errors in background fetch
-				lastFetchTime = time.Now()
-			}
-		}
-	}()
-}
-
-func fetchIfNeeded(repo *git.Repository) error {
-	if time.Since(lastFetchTime) < fetchInterval {
-		return nil // Skip fetch if it was done recently
-	}
-	err := fetchRepo(repo)
-	if err == nil {
-		lastFetchTime = time.Now()
+// FetchSlides returns the slides of a branch of the clone in repoPath, fetching first
+func FetchSlides(ctx context.Context, repoPath, branchName string) (string, error) {
+	r, err := OpenRepository(repoPath)
+	if err != nil {
+		return "", err
 	}
-	return err
+	return r.Slides(ctx, branchName)
 }
 
-func FetchSlides(repoPath, branchName string) (string, error) {
-	repo, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return "", fmt.Errorf("error opening repository: %v", err)
+// EnsureNsfwctlRepo ensures that the nsfwctl repository exists in repoDir and is up to date.
+// repoURL may also be a local git repository or a plain directory of stage folders. Cloning
+// and fetching stop when ctx is done.
+func EnsureNsfwctlRepo(ctx context.Context, repoURL, branch, repoDir string) (string, error) {
+	if err := utils.EnsureDirectory(filepath.Dir(repoDir)); err != nil {
+		return "", fmt.Errorf("error creating clone directory: %v", err)
 	}
 
-	// Fetch the latest changes from the remote
-	err = fetchRepo(repo)
-	if err != nil {
-		return "", fmt.Errorf("error fetching repository: %v", err)
+	repoURL = resolveRepoURL(repoURL)
+	if sourceDir, ok := sourceDirectory(repoURL); ok {
+		return ensureDirectoryClone(ctx, sourceDir, branch, repoDir)
 	}
 
-	w, err := repo.Worktree()
+	r, err := openRepository(repoDir)
+	if err == git.ErrRepositoryNotExists {
+		if offlineRequested() {
+			return "", fmt.Errorf("offline mode is on, but there is no local clone in %s yet; go online once to clone the curriculum", repoDir)
+		}
+		return cloneRepo(ctx, repoURL, branch, repoDir)
+	}
 	if err != nil {
-		return "", fmt.Errorf("error getting worktree: %v", err)
+		return "", fmt.Errorf("error opening repository: %v", err)
 	}
 
-	// Try to checkout the branch
-	err = w.Checkout(&git.CheckoutOptions{
-		Branch: plumbing.NewRemoteReferenceName("origin", branchName),
-		Force:  true,
-	})
-	if err != nil {
-		// If checkout fails, try to create and checkout the branch
-		err = w.Checkout(&git.CheckoutOptions{
-			Branch: plumbing.NewBranchReferenceName(branchName),
-			Create: true,
-			Force:  true,
-		})
-		if err != nil {
-			return "", fmt.Errorf("error checking out branch: %v", err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setDefaultBranch(branch)
+
+	if changed, err := setOriginURL(r.repo, repoURL); err != nil {
+		return "", err
+	} else if changed {
+		// Drop the branches of the previous curriculum along with fetching the new one
+		log.Printf("Repository URL changed to %s, re-fetching", repoURL)
+		r.invalidateBranches()
+		if err := r.fetch(ctx); err != nil {
+			return "", err
 		}
+		return repoDir, checkoutDefaultBranch(r.repo, branch)
 	}
 
-	// Pull the latest changes for the branch
-	err = w.Pull(&git.PullOptions{RemoteName: "origin"})
-	if err != nil && err != git.NoErrAlreadyUpToDate {
-		return "", fmt.Errorf("error pulling latest changes: %v", err)
+	// Without the network the local clone is used as it is
+	if err := r.fetch(ctx); err != nil && ctx.Err() != nil {
+		return "", err
 	}
 
-	slidesPath := filepath.Join(repoPath, "slides", "slides.md")
-	content, err := ioutil.ReadFile(slidesPath)
-	if err != nil {
-		return "", fmt.Errorf("error reading slides: %v", err)
+	if head, err := r.repo.Head(); err == nil && head.Name() != plumbing.NewBranchReferenceName(branch) {
+		log.Printf("Default branch changed to %s, checking it out", branch)
+		r.invalidateBranches()
+		return repoDir, checkoutDefaultBranch(r.repo, branch)
 	}
 
-	return string(content), nil
+	return repoDir, nil
 }
 
-// EnsureNsfwctlRepo ensures that the nsfwctl repository exists and is up to date
+// checkoutDefaultBranch checks out the latest fetched commit of branch in the main clone
+func checkoutDefaultBranch(repo *git.Repository, branch string) error {
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+	if err != nil {
+		return fmt.Errorf("error resolving branch %s: %v", branch, err)
+	}
 
-func EnsureNsfwctlRepo(repoURL, branch string) (string, error) {
-	appDir, err := utils.GetAppDir()
+	w, err := repo.Worktree()
 	if err != nil {
-		return "", fmt.Errorf("error getting app directory: %v", err)
+		return fmt.Errorf("error getting worktree: %v", err)
+	}
+
+	opts := &git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch), Force: true}
+	if _, err := repo.Reference(opts.Branch, false); err != nil {
+		opts.Create = true
+		opts.Hash = remoteRef.Hash()
 	}
-	repoDir := filepath.Join(appDir, "infra")
-	if err := utils.EnsureDirectory(appDir); err != nil {
-		return "", fmt.Errorf("error creating app directory: %v", err)
+	if err := w.Checkout(opts); err != nil {
+		return fmt.Errorf("error checking out %s: %v", branch, err)
 	}
+	if err := w.Reset(&git.ResetOptions{Commit: remoteRef.Hash(), Mode: git.HardReset}); err != nil {
+		return fmt.Errorf("error resetting %s: %v", branch, err)
+	}
+	return nil
+}
 
-	repo, err := git.PlainOpen(repoDir)
+// setOriginURL points the origin remote of an existing clone at repoURL, reporting whether it changed
+func setOriginURL(repo *git.Repository, repoURL string) (bool, error) {
+	cfg, err := repo.Config()
 	if err != nil {
-		if err == git.ErrRepositoryNotExists {
-			return cloneRepo(repoURL, branch, repoDir)
-		}
-		return "", fmt.Errorf("error opening repository: %v", err)
+		return false, fmt.Errorf("error reading repository config: %v", err)
 	}
+	origin, ok := cfg.Remotes["origin"]
+	if !ok {
+		return false, fmt.Errorf("repository has no origin remote")
+	}
+	if len(origin.URLs) > 0 && origin.URLs[0] == repoURL {
+		return false, nil
+	}
+	origin.URLs = []string{repoURL}
+	if err := repo.SetConfig(cfg); err != nil {
+		return false, fmt.Errorf("error updating repository config: %v", err)
+	}
+	return true, nil
+}
 
-	if err := fetchRepo(repo); err != nil {
+func cloneRepo(ctx context.Context, repoURL, branch, repoDir string) (string, error) {
+	auth, err := authMethod(repoURL)
+	if err != nil {
 		return "", err
 	}
 
-	return repoDir, nil
-}
-
-func cloneRepo(repoURL, branch, repoDir string) (string, error) {
-	fmt.Println("Cloning repository...")
-	_, err := git.PlainClone(repoDir, false, &git.CloneOptions{
+	fmt.Fprintln(os.Stderr, "Cloning repository...")
+	repo, err := git.PlainCloneContext(ctx, repoDir, false, &git.CloneOptions{
 		URL:           repoURL,
-		Progress:      os.Stdout,
+		Auth:          auth,
+		Progress:      os.Stderr,
 		ReferenceName: plumbing.NewBranchReferenceName(branch),
 	})
 	if err != nil {
 		return "", fmt.Errorf("error cloning repository: %v", err)
 	}
+	markSynced(repo)
+	registerRepository(repoDir, branch, repo)
 	return repoDir, nil
 }
 
@@ -155,101 +160,124 @@ func cloneRepo(repoURL, branch, repoDir string) (string, error) {
 // }
 
 type BranchInfo struct {
-	Name        string
-	Description string
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Manifest    *StageManifest `json:"manifest,omitempty"` // nil if the stage has no manifest
 }
 
-func fetchRepo(repo *git.Repository) error {
-	fmt.Println("Fetching updates from remote...")
-	err := repo.Fetch(&git.FetchOptions{
+// fetchRepo fetches origin, dropping branches deleted upstream. In offline mode nothing is
+// fetched; a failed fetch switches to working offline until a later fetch succeeds.
+func fetchRepo(ctx context.Context, repo *git.Repository) error {
+	if offlineRequested() {
+		return nil
+	}
+
+	if sourceDir, ok := directoryOrigin(repo); ok {
+		if err := importDirectory(repo, sourceDir); err != nil {
+			markFetchFailed(err)
+			return err
+		}
+		markSynced(repo)
+		return nil
+	}
+
+	log.Println("Fetching updates from remote...")
+	auth, err := originAuth(repo)
+	if err != nil {
+		markFetchFailed(err)
+		return err
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
 		RemoteName: "origin",
+		Auth:       auth,
 		Progress:   nil,
+		Prune:      true,
+		Force:      true,
 	})
 	if err != nil && err != git.NoErrAlreadyUpToDate {
+		// A cancelled fetch says nothing about the network
+		if ctx.Err() == nil {
+			markFetchFailed(err)
+		}
 		return fmt.Errorf("error fetching repository: %v", err)
 	}
+	markSynced(repo)
 	return nil
 }
 
-func FetchBranchesWithDescriptions(repoPath string) ([]BranchInfo, error) {
-	branchCacheMux.RLock()
-	if time.Since(lastBranchFetch) < fetchInterval && len(branchCache) > 0 {
-		defer branchCacheMux.RUnlock()
-		return branchCache, nil
+// branchNames lists the branches of origin, or the remote-tracking branches of the local
+// clone when offline or when origin is a plain directory
+func branchNames(ctx context.Context, repo *git.Repository) ([]string, error) {
+	if _, ok := directoryOrigin(repo); ok || Offline() {
+		return localBranches(repo)
 	}
-	branchCacheMux.RUnlock()
-
-	branchCacheMux.Lock()
-	defer branchCacheMux.Unlock()
 
-	repo, err := git.PlainOpen(repoPath)
+	remote, err := repo.Remote("origin")
 	if err != nil {
-		return nil, fmt.Errorf("error opening repository: %v", err)
+		return nil, fmt.Errorf("error getting origin remote: %v", err)
 	}
-
-	if err := fetchIfNeeded(repo); err != nil {
-		return nil, fmt.Errorf("error fetching repository: %v", err)
+	auth, err := originAuth(repo)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil && ctx.Err() != nil {
+		return nil, err
 	}
-
-	remotes, err := repo.Remotes()
 	if err != nil {
-		return nil, fmt.Errorf("error getting remotes: %v", err)
+		markFetchFailed(err)
+		return localBranches(repo)
 	}
 
-	var branchInfos []BranchInfo
-	for _, remote := range remotes {
-		refs, err := remote.List(&git.ListOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("error listing remote references: %v", err)
-		}
-
-		for _, ref := range refs {
-			if ref.Name().IsBranch() {
-				branchName := ref.Name().Short()
-				if utils.IsValidBranchName(branchName) {
-					description, _ := getBranchDescription(repo, branchName)
-					branchInfos = append(branchInfos, BranchInfo{
-						Name:        branchName,
-						Description: description,
-					})
-				}
-			}
+	var branches []string
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			branches = append(branches, ref.Name().Short())
 		}
 	}
+	return branches, nil
+}
 
-	branchCache = branchInfos
-	lastBranchFetch = time.Now()
-
-	return branchInfos, nil
+// FetchBranchesWithDescriptions lists the stage branches of the clone in repoPath
+func FetchBranchesWithDescriptions(ctx context.Context, repoPath string) ([]BranchInfo, error) {
+	r, err := OpenRepository(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	return r.Branches(ctx)
 }
 
-func getBranchDescription(repo *git.Repository, branchName string) (string, error) {
-	w, err := repo.Worktree()
+// readBranchFile reads a file from the tip of a remote branch without touching any worktree
+func readBranchFile(repo *git.Repository, branchName, path string) (string, error) {
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", branchName), true)
 	if err != nil {
 		return "", err
 	}
 
-	// Try to checkout the branch
-	err = w.Checkout(&git.CheckoutOptions{
-		Branch: plumbing.NewRemoteReferenceName("origin", branchName),
-		Force:  true,
-	})
+	commit, err := repo.CommitObject(ref.Hash())
 	if err != nil {
-		// If checkout fails, it might be a remote-only branch
-		return "Remote branch - description not available", nil
+		return "", err
 	}
 
-	descriptionPath := filepath.Join(w.Filesystem.Root(), "description.md")
-	file, err := os.Open(descriptionPath)
+	file, err := commit.File(path)
 	if err != nil {
-		if os.IsNotExist(err) {
+		return "", err
+	}
+
+	return file.Contents()
+}
+
+func getBranchDescription(repo *git.Repository, branchName string) (string, error) {
+	content, err := readBranchFile(repo, branchName, "description.md")
+	if err != nil {
+		if err == object.ErrFileNotFound {
 			return "No description available", nil
 		}
-		return "", err
+		// The branch might not have been fetched yet
+		return "Remote branch - description not available", nil
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(strings.NewReader(content))
 	var lines []string
 	lineCount := 0
 	maxLines := 5 // Adjust this number to read more or fewer lines
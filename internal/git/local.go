@@ -0,0 +1,332 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+// A curriculum can be a local git repository (bare or not), given as a path or a file://
+// URL, or a plain directory. A plain directory is imported into the clone instead of being
+// fetched: its top-level files become the default branch and every subfolder becomes a
+// stage branch of the same name.
+
+// resolveRepoURL turns a relative or ~/ path into an absolute one, so the clone keeps
+// pointing at the same directory whatever the working directory is
+func resolveRepoURL(repoURL string) string {
+	if strings.HasPrefix(repoURL, "file://") {
+		return repoURL
+	}
+	if path, ok := utils.LocalRepoPath(repoURL); ok {
+		return path
+	}
+	return repoURL
+}
+
+// sourceDirectory returns the directory repoURL points at if it is a plain directory
+// rather than a git repository
+func sourceDirectory(repoURL string) (string, bool) {
+	path, ok := utils.LocalRepoPath(repoURL)
+	if !ok {
+		return "", false
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return "", false
+	}
+	if _, err := git.PlainOpen(path); err != git.ErrRepositoryNotExists {
+		return "", false
+	}
+	return path, true
+}
+
+// originURL returns the URL of the origin remote of repo
+func originURL(repo *git.Repository) (string, error) {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return "", fmt.Errorf("error getting origin remote: %v", err)
+	}
+	urls := remote.Config().URLs
+	if len(urls) == 0 {
+		return "", nil
+	}
+	return urls[0], nil
+}
+
+// isLocalOrigin reports whether the origin of repo is on the local filesystem, where
+// fetching is cheap enough to do every time
+func isLocalOrigin(repo *git.Repository) bool {
+	url, err := originURL(repo)
+	if err != nil {
+		return false
+	}
+	_, ok := utils.LocalRepoPath(url)
+	return ok
+}
+
+// directoryOrigin returns the directory the origin of repo is imported from, if it is a
+// plain directory
+func directoryOrigin(repo *git.Repository) (string, bool) {
+	url, err := originURL(repo)
+	if err != nil {
+		return "", false
+	}
+	return sourceDirectory(url)
+}
+
+// ensureDirectoryClone sets up the clone of a plain directory curriculum in repoDir,
+// imports the directory and checks out branch
+func ensureDirectoryClone(ctx context.Context, sourceDir, branch, repoDir string) (string, error) {
+	r, err := openRepository(repoDir)
+	if err == git.ErrRepositoryNotExists {
+		if offlineRequested() {
+			return "", fmt.Errorf("offline mode is on, but there is no local clone in %s yet; go online once to import the curriculum", repoDir)
+		}
+		log.Printf("Importing curriculum from %s", sourceDir)
+		repo, err := git.PlainInitWithOptions(repoDir, &git.PlainInitOptions{
+			InitOptions: git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName(branch)},
+		})
+		if err != nil {
+			return "", fmt.Errorf("error creating repository: %v", err)
+		}
+		if _, err := repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{sourceDir}}); err != nil {
+			return "", fmt.Errorf("error creating origin remote: %v", err)
+		}
+		r = registerRepository(repoDir, branch, repo)
+	} else if err != nil {
+		return "", fmt.Errorf("error opening repository: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setDefaultBranch(branch)
+
+	if changed, err := setOriginURL(r.repo, sourceDir); err != nil {
+		return "", err
+	} else if changed {
+		log.Printf("Repository URL changed to %s, importing it", sourceDir)
+		r.invalidateBranches()
+	}
+
+	// The import names the top-level snapshot after the branch HEAD points at
+	head := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(branch))
+	if err := r.repo.Storer.SetReference(head); err != nil {
+		return "", fmt.Errorf("error setting HEAD: %v", err)
+	}
+	if err := r.fetch(ctx); err != nil {
+		return "", err
+	}
+	return repoDir, checkoutDefaultBranch(r.repo, branch)
+}
+
+// importDirectory snapshots a plain directory into the remote-tracking branches of repo,
+// committing only what changed since the last import and dropping stages that are gone
+func importDirectory(repo *git.Repository, sourceDir string) error {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Type() != plumbing.SymbolicReference {
+		return fmt.Errorf("error resolving the default branch: %v", err)
+	}
+	defaultBranch := head.Target().Short()
+
+	trees := make(map[string]plumbing.Hash)
+	tree, _, err := storeTree(repo.Storer, sourceDir, true)
+	if err != nil {
+		return fmt.Errorf("error importing %s: %v", sourceDir, err)
+	}
+	trees[defaultBranch] = tree
+
+	entries, err := os.ReadDir(sourceDir)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", sourceDir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(name, ".") || !utils.IsValidBranchName(name) {
+			continue
+		}
+		if name == defaultBranch {
+			log.Printf("Skipping stage folder %s, it has the name of the default branch", name)
+			continue
+		}
+		tree, count, err := storeTree(repo.Storer, filepath.Join(sourceDir, name), false)
+		if err != nil {
+			return fmt.Errorf("error importing %s: %v", name, err)
+		}
+		if count > 0 {
+			trees[name] = tree
+		}
+	}
+
+	for name, tree := range trees {
+		if err := snapshotBranch(repo, name, tree, sourceDir); err != nil {
+			return fmt.Errorf("error importing %s: %v", name, err)
+		}
+	}
+
+	branches, err := localBranches(repo)
+	if err != nil {
+		return err
+	}
+	for _, name := range branches {
+		if _, ok := trees[name]; !ok {
+			log.Printf("Stage folder %s is gone, removing its branch", name)
+			if err := repo.Storer.RemoveReference(plumbing.NewRemoteReferenceName("origin", name)); err != nil {
+				return fmt.Errorf("error removing branch %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// snapshotBranch points the remote-tracking branch name at a commit of tree, unless its
+// tip already has that tree
+func snapshotBranch(repo *git.Repository, name string, tree plumbing.Hash, sourceDir string) error {
+	now := time.Now()
+	commit := &object.Commit{
+		Author:    object.Signature{Name: "nsfwctl", Email: "nsfwctl@localhost", When: now},
+		Committer: object.Signature{Name: "nsfwctl", Email: "nsfwctl@localhost", When: now},
+		Message:   fmt.Sprintf("Import %s\n", sourceDir),
+		TreeHash:  tree,
+	}
+
+	refName := plumbing.NewRemoteReferenceName("origin", name)
+	if ref, err := repo.Reference(refName, true); err == nil {
+		parent, err := repo.CommitObject(ref.Hash())
+		if err == nil && parent.TreeHash == tree {
+			return nil
+		}
+		if err == nil {
+			commit.ParentHashes = []plumbing.Hash{parent.Hash}
+		}
+	}
+
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return err
+	}
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %s at %s", name, hash)
+	return repo.Storer.SetReference(plumbing.NewHashReference(refName, hash))
+}
+
+// skipImport reports whether a file or folder is left out of an import: git metadata and
+// the terraform working files a stage folder collects when it is applied in place
+func skipImport(name string) bool {
+	return name == ".git" || name == ".terraform" || strings.Contains(name, ".tfstate")
+}
+
+// storeTree stores the contents of dir as a tree object, leaving out subfolders when
+// filesOnly is set. It returns the tree and the number of entries in it.
+func storeTree(s storer.EncodedObjectStorer, dir string, filesOnly bool) (plumbing.Hash, int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return plumbing.ZeroHash, 0, err
+	}
+
+	var tree object.Tree
+	for _, entry := range entries {
+		name := entry.Name()
+		if skipImport(name) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := entry.Info()
+		if err != nil {
+			return plumbing.ZeroHash, 0, err
+		}
+
+		var (
+			hash plumbing.Hash
+			mode filemode.FileMode
+		)
+		switch {
+		case info.IsDir():
+			if filesOnly {
+				continue
+			}
+			var count int
+			hash, count, err = storeTree(s, path, false)
+			if count == 0 {
+				continue // git has no empty folders
+			}
+			mode = filemode.Dir
+		case info.Mode()&os.ModeSymlink != 0:
+			var target string
+			if target, err = os.Readlink(path); err == nil {
+				hash, err = storeBlob(s, []byte(filepath.ToSlash(target)))
+			}
+			mode = filemode.Symlink
+		case info.Mode().IsRegular():
+			var data []byte
+			if data, err = os.ReadFile(path); err == nil {
+				hash, err = storeBlob(s, data)
+			}
+			mode = filemode.Regular
+			if info.Mode()&0111 != 0 {
+				mode = filemode.Executable
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return plumbing.ZeroHash, 0, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: mode, Hash: hash})
+	}
+
+	// git orders tree entries by name, comparing folders as if they ended in a slash
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return sortName(tree.Entries[i]) < sortName(tree.Entries[j])
+	})
+
+	obj := s.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, 0, err
+	}
+	hash, err := s.SetEncodedObject(obj)
+	return hash, len(tree.Entries), err
+}
+
+// storeBlob stores data as a blob object, unless the object store already has it
+func storeBlob(s storer.EncodedObjectStorer, data []byte) (plumbing.Hash, error) {
+	hash := plumbing.ComputeHash(plumbing.BlobObject, data)
+	if s.HasEncodedObject(hash) == nil {
+		return hash, nil
+	}
+
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(int64(len(data)))
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
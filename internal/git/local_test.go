@@ -0,0 +1,167 @@
+package git
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates files under dir, with the folders they are in
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkImport checks the branches, slides and worktrees of a clone imported from a plain
+// directory against the stage folders it should hold
+func checkImport(t *testing.T, r *Repository, stagesDir string, stages map[string]string) {
+	t.Helper()
+	branches, err := r.Branches(context.Background())
+	if err != nil {
+		t.Fatalf("branches: %v", err)
+	}
+	var names []string
+	for _, b := range branches {
+		names = append(names, b.Name)
+	}
+	want := []string{"main"}
+	for stage := range stages {
+		want = append(want, stage)
+	}
+	sort.Strings(want) // without manifests, stages are listed by name
+	if got := strings.Join(names, " "); got != strings.Join(want, " ") {
+		t.Errorf("branches = %s, want %s", got, strings.Join(want, " "))
+	}
+
+	for stage, mainTF := range stages {
+		slides, err := r.Slides(context.Background(), stage)
+		if err != nil || slides != "# "+stage+"\n" {
+			t.Errorf("slides of %s = %q (%v)", stage, slides, err)
+		}
+		stagePath, err := r.EnsureStageWorktree(stagesDir, stage)
+		if err != nil {
+			t.Fatalf("worktree of %s: %v", stage, err)
+		}
+		content, err := os.ReadFile(filepath.Join(stagePath, "main.tf"))
+		if err != nil || string(content) != mainTF {
+			t.Errorf("worktree of %s has main.tf %q (%v), want %q", stage, content, err, mainTF)
+		}
+	}
+}
+
+// TestImportDirectory imports a plain directory curriculum, then changes, adds and removes
+// stage folders and imports it again
+func TestImportDirectory(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	source := t.TempDir()
+	stagesDir := t.TempDir()
+	writeFiles(t, source, map[string]string{
+		"README.md":                    "# Curriculum\n",
+		"stage-1/main.tf":              "# stage-1\n",
+		"stage-1/slides/slides.md":     "# stage-1\n",
+		"stage-1/slides.md.bak":        "sorts before the slides folder in git\n",
+		"stage-1/terraform.tfstate":    "{}",
+		"stage-1/.terraform/providers": "left out of the import",
+		"stage-2/main.tf":              "# stage-2\n",
+		"stage-2/slides/slides.md":     "# stage-2\n",
+		"main/main.tf":                 "# has the name of the default branch\n",
+	})
+	if err := os.MkdirAll(filepath.Join(source, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.WriteFile(filepath.Join(source, "stage-1", "setup.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("main.tf", filepath.Join(source, "stage-1", "link.tf")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repoDir, err := EnsureNsfwctlRepo(context.Background(), source, "main", filepath.Join(t.TempDir(), "infra"))
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	r, err := OpenRepository(repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImport(t, r, stagesDir, map[string]string{"stage-1": "# stage-1\n", "stage-2": "# stage-2\n"})
+
+	stagePath, err := r.EnsureStageWorktree(stagesDir, "stage-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"terraform.tfstate", ".terraform"} {
+		if _, err := os.Stat(filepath.Join(stagePath, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was imported (%v)", name, err)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(filepath.Join(stagePath, "setup.sh")); err != nil || info.Mode()&0111 == 0 {
+			t.Errorf("setup.sh isn't executable in the worktree (%v)", err)
+		}
+		if target, err := os.Readlink(filepath.Join(stagePath, "link.tf")); err != nil || target != "main.tf" {
+			t.Errorf("link.tf points at %q (%v), want main.tf", target, err)
+		}
+	}
+
+	// Change stage-1, add stage-3 and remove stage-2
+	writeFiles(t, source, map[string]string{
+		"stage-1/main.tf":          "# stage-1, updated\n",
+		"stage-3/main.tf":          "# stage-3\n",
+		"stage-3/slides/slides.md": "# stage-3\n",
+	})
+	if err := os.RemoveAll(filepath.Join(source, "stage-2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Fetch(context.Background()); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	checkImport(t, r, stagesDir, map[string]string{"stage-1": "# stage-1, updated\n", "stage-3": "# stage-3\n"})
+	if _, err := r.EnsureStageWorktree(stagesDir, "stage-2"); err == nil {
+		t.Error("stage-2 can still be checked out after its folder was removed")
+	}
+
+	// Importing an unchanged directory keeps the branches where they are
+	before, err := remoteBranches(r.repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Fetch(context.Background()); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	after, err := remoteBranches(r.repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, hash := range before {
+		if after[name] != hash {
+			t.Errorf("%s moved from %s to %s without changes", name, hash, after[name])
+		}
+	}
+
+	// git itself has to accept the hand-encoded trees and commits
+	if _, err := exec.LookPath("git"); err == nil {
+		if out, err := exec.Command("git", "-C", repoDir, "fsck", "--strict").CombinedOutput(); err != nil {
+			t.Errorf("git fsck: %v\n%s", err, out)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest files read from each stage branch, in order of preference
+var manifestFiles = []string{"stage.yaml", "stage.yml", "stage.json"}
+
+// Catalog files read from the default branch, mapping branch names to manifests
+var catalogFiles = []string{"stages.yaml", "stages.yml", "stages.json"}
+
+// StageManifest describes a stage: how to present it and where it sits in the curriculum
+type StageManifest struct {
+	Title         string   `json:"title" yaml:"title"`
+	Order         int      `json:"order" yaml:"order"`
+	Difficulty    string   `json:"difficulty" yaml:"difficulty"`
+	EstimatedCost string   `json:"estimated_cost" yaml:"estimated_cost"`
+	Prerequisites []string `json:"prerequisites" yaml:"prerequisites"`
+	Tags          []string `json:"tags" yaml:"tags"`
+}
+
+// readManifest reads the stage manifest from the tip of a branch. It returns nil if the
+// branch has no manifest.
+func readManifest(repo *git.Repository, branchName string) (*StageManifest, error) {
+	for _, name := range manifestFiles {
+		content, err := readBranchFile(repo, branchName, name)
+		if err == object.ErrFileNotFound || err == plumbing.ErrReferenceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var manifest StageManifest
+		if err := decodeManifest(name, content, &manifest); err != nil {
+			return nil, fmt.Errorf("error parsing %s on %s: %v", name, branchName, err)
+		}
+		return &manifest, nil
+	}
+	return nil, nil
+}
+
+// readCatalog reads the stage catalog from the tip of the default branch. It returns nil
+// if there is no catalog.
+func readCatalog(repo *git.Repository, defaultBranch string) (map[string]StageManifest, error) {
+	for _, name := range catalogFiles {
+		content, err := readBranchFile(repo, defaultBranch, name)
+		if err == object.ErrFileNotFound || err == plumbing.ErrReferenceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var catalog map[string]StageManifest
+		if err := decodeManifest(name, content, &catalog); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", name, err)
+		}
+		return catalog, nil
+	}
+	return nil, nil
+}
+
+func decodeManifest(name, content string, v interface{}) error {
+	if strings.HasSuffix(name, ".json") {
+		return json.Unmarshal([]byte(content), v)
+	}
+	return yaml.Unmarshal([]byte(content), v)
+}
+
+// SortBranches orders stages by their manifest order, then by name. Stages whose manifest
+// has no order come after the ordered ones, and branches without a manifest come last.
+func SortBranches(branches []BranchInfo) {
+	rank := func(b BranchInfo) int {
+		switch {
+		case b.Manifest == nil:
+			return 2
+		case b.Manifest.Order == 0:
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(branches, func(i, j int) bool {
+		a, b := branches[i], branches[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if rank(a) == 0 && a.Manifest.Order != b.Manifest.Order {
+			return a.Manifest.Order < b.Manifest.Order
+		}
+		return a.Name < b.Name
+	})
+}
@@ -0,0 +1,77 @@
+package git
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// TestBranchesReadCatalogAfterClone adds a catalog to the default branch upstream after the
+// clone was made
+func TestBranchesReadCatalogAfterClone(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	origin := newOrigin(t, "stage-1")
+	repoDir, err := EnsureNsfwctlRepo(context.Background(), origin, "main", filepath.Join(t.TempDir(), "infra"))
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+
+	originRepo, err := git.PlainOpen(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := originRepo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("main")}); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, originRepo, origin, "stages.yaml", "stage-1:\n  title: First stage\n  order: 1\n")
+
+	if _, err := EnsureNsfwctlRepo(context.Background(), origin, "main", repoDir); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	branches, err := FetchBranchesWithDescriptions(context.Background(), repoDir)
+	if err != nil {
+		t.Fatalf("branches: %v", err)
+	}
+	for _, b := range branches {
+		if b.Name != "stage-1" {
+			continue
+		}
+		if b.Manifest == nil || b.Manifest.Title != "First stage" {
+			t.Errorf("stage-1 manifest = %+v, want the one from the catalog", b.Manifest)
+		}
+		return
+	}
+	t.Errorf("stage-1 is missing from %+v", branches)
+}
+
+func TestSortBranches(t *testing.T) {
+	branches := []BranchInfo{
+		{Name: "main"},
+		{Name: "sg", Manifest: &StageManifest{Prerequisites: []string{"vpc"}}},
+		{Name: "eks", Manifest: &StageManifest{Order: 2}},
+		{Name: "vpc", Manifest: &StageManifest{Order: 1}},
+		{Name: "alb", Manifest: &StageManifest{}},
+	}
+	SortBranches(branches)
+
+	var names []string
+	for _, b := range branches {
+		names = append(names, b.Name)
+	}
+	if got, want := strings.Join(names, " "), "vpc eks alb sg main"; got != want {
+		t.Errorf("sorted branches = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,150 @@
+package git
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+// lastSyncFile records when the clone last fetched successfully, inside its .git directory
+const lastSyncFile = "nsfwctl-last-sync"
+
+var (
+	offlineMux   sync.Mutex
+	forceOffline bool  // offline mode was requested
+	fetchErr     error // the last fetch failed, so the clone may be stale
+)
+
+// SetOffline turns offline mode on or off. While offline nothing is fetched; branches
+// and slides come from the remote-tracking refs of the local clone.
+func SetOffline(offline bool) {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+	forceOffline = offline
+}
+
+// Offline reports whether nsfwctl is working from the local clone only, because offline
+// mode is on or because the last fetch failed
+func Offline() bool {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+	return forceOffline || fetchErr != nil
+}
+
+// OfflineReason explains why nsfwctl is offline, or returns "" when it is online
+func OfflineReason() string {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+	switch {
+	case forceOffline:
+		return "offline mode is on"
+	case fetchErr != nil:
+		return fmt.Sprintf("fetching failed: %v", fetchErr)
+	}
+	return ""
+}
+
+func offlineRequested() bool {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+	return forceOffline
+}
+
+// markFetchFailed switches to working from the local clone until a fetch succeeds
+func markFetchFailed(err error) {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+	if fetchErr == nil {
+		log.Printf("Working offline from the local clone: %v", err)
+	}
+	fetchErr = err
+}
+
+// markSynced records a successful fetch or clone of repo
+func markSynced(repo *git.Repository) {
+	offlineMux.Lock()
+	if fetchErr != nil {
+		log.Printf("Fetching works again, back online")
+	}
+	fetchErr = nil
+	offlineMux.Unlock()
+
+	storage, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return
+	}
+	path := filepath.Join(storage.Filesystem().Root(), lastSyncFile)
+	if err := os.WriteFile(path, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		log.Printf("Error recording sync time: %v", err)
+	}
+}
+
+// LastSync returns when the clone in repoPath last fetched successfully, or the zero time if unknown
+func LastSync(repoPath string) time.Time {
+	data, err := os.ReadFile(filepath.Join(repoPath, ".git", lastSyncFile))
+	if err != nil {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// OfflineBanner describes the offline state for display, e.g. "offline, last synced at
+// 2024-08-01 14:03 (2h ago)", or returns "" when online
+func OfflineBanner(repoPath string) string {
+	if !Offline() {
+		return ""
+	}
+	last := LastSync(repoPath)
+	if last.IsZero() {
+		return "offline, last sync time unknown"
+	}
+	return fmt.Sprintf("offline, last synced at %s (%s ago)", last.Format("2006-01-02 15:04"), utils.FormatDuration(time.Since(last).Truncate(time.Minute)))
+}
+
+// localBranches lists the branches known from the clone's remote-tracking refs
+func localBranches(repo *git.Repository) ([]string, error) {
+	hashes, err := remoteBranches(repo)
+	if err != nil {
+		return nil, err
+	}
+	branches := make([]string, 0, len(hashes))
+	for name := range hashes {
+		branches = append(branches, name)
+	}
+	sort.Strings(branches)
+	return branches, nil
+}
+
+// remoteBranches maps the clone's remote-tracking branches to the commits they point at
+func remoteBranches(repo *git.Repository) (map[string]plumbing.Hash, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("error listing references: %v", err)
+	}
+	defer refs.Close()
+
+	prefix := "refs/remotes/origin/"
+	branches := make(map[string]plumbing.Hash)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(name, prefix) {
+			branches[strings.TrimPrefix(name, prefix)] = ref.Hash()
+		}
+		return nil
+	})
+	return branches, err
+}
@@ -0,0 +1,57 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PrerequisiteChain returns every stage the target stage builds on, directly or
+// transitively, in the order they have to be deployed. The target itself is not included.
+func PrerequisiteChain(branches []BranchInfo, target string) ([]string, error) {
+	byName := make(map[string]BranchInfo, len(branches))
+	for _, b := range branches {
+		byName[b.Name] = b
+	}
+
+	var chain []string
+	visited := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("prerequisite cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+		info, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown prerequisite stage %q (required by %s)", name, path[len(path)-1])
+		}
+
+		visiting[name] = true
+		if info.Manifest != nil {
+			for _, prereq := range info.Manifest.Prerequisites {
+				if err := visit(prereq, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		visiting[name] = false
+		visited[name] = true
+
+		if name != target {
+			chain = append(chain, name)
+		}
+		return nil
+	}
+
+	if _, ok := byName[target]; !ok {
+		return nil, fmt.Errorf("unknown stage %q", target)
+	}
+	if err := visit(target, nil); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
@@ -0,0 +1,296 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+// fetchInterval is how often origin is fetched in the background, and how long fetched
+// branches are trusted; tests shorten it
+var fetchInterval = 5 * time.Minute
+
+// Repository owns the go-git handle of a clone and serializes everything done with it:
+// fetching, checking out and reading branches never overlap
+type Repository struct {
+	path          string
+	defaultBranch string // the branch the stage catalog is read from
+
+	mu            sync.Mutex
+	repo          *git.Repository
+	lastFetch     time.Time
+	branches      []BranchInfo
+	branchesAt    time.Time
+	branchesLocal bool                     // the branches come from a local origin, which is always re-read
+	refs          map[string]plumbing.Hash // the remote-tracking branches when they were last listed
+}
+
+// RefChanges lists the branches of origin that appeared, moved or disappeared
+type RefChanges struct {
+	Added   []string
+	Updated []string
+	Removed []string
+}
+
+// Empty reports whether nothing changed
+func (c RefChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Updated) == 0 && len(c.Removed) == 0
+}
+
+func (c RefChanges) String() string {
+	var parts []string
+	if len(c.Added) > 0 {
+		parts = append(parts, fmt.Sprintf("%d new", len(c.Added)))
+	}
+	if len(c.Updated) > 0 {
+		parts = append(parts, fmt.Sprintf("%d updated", len(c.Updated)))
+	}
+	if len(c.Removed) > 0 {
+		parts = append(parts, fmt.Sprintf("%d removed", len(c.Removed)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+var (
+	repositories   = make(map[string]*Repository)
+	repositoriesMu sync.Mutex
+)
+
+// OpenRepository returns the Repository for the clone in path, opening it on first use.
+// Every caller gets the same Repository for the same path.
+func OpenRepository(path string) (*Repository, error) {
+	r, err := openRepository(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening repository: %v", err)
+	}
+	return r, nil
+}
+
+// openRepository is OpenRepository returning git.ErrRepositoryNotExists as it is
+func openRepository(path string) (*Repository, error) {
+	repositoriesMu.Lock()
+	defer repositoriesMu.Unlock()
+	if r, ok := repositories[path]; ok {
+		return r, nil
+	}
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Repository{path: path, defaultBranch: headBranch(repo), repo: repo}
+	repositories[path] = r
+	return r, nil
+}
+
+// registerRepository hands a freshly cloned or created repository to its Repository
+func registerRepository(path, defaultBranch string, repo *git.Repository) *Repository {
+	repositoriesMu.Lock()
+	defer repositoriesMu.Unlock()
+	r := &Repository{path: path, defaultBranch: defaultBranch, repo: repo, lastFetch: time.Now()}
+	repositories[path] = r
+	return r
+}
+
+// headBranch returns the branch HEAD of repo points at, which is the default branch of a
+// clone until EnsureNsfwctlRepo says otherwise
+func headBranch(repo *git.Repository) string {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Type() != plumbing.SymbolicReference {
+		return ""
+	}
+	return head.Target().Short()
+}
+
+// setDefaultBranch sets the branch the stage catalog is read from, dropping the cached
+// branch list if it changed. r.mu must be held.
+func (r *Repository) setDefaultBranch(branch string) {
+	if r.defaultBranch != branch {
+		r.defaultBranch = branch
+		r.invalidateBranches()
+	}
+}
+
+// Path returns the directory of the clone
+func (r *Repository) Path() string {
+	return r.path
+}
+
+// Fetch fetches origin, or imports it if it is a plain directory
+func (r *Repository) Fetch(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fetch(ctx)
+}
+
+// BackgroundFetch fetches origin every fetchInterval, unless something else fetched in
+// the meantime, until ctx is done. An in-flight fetch is cancelled along with ctx. When
+// the branches differ from the ones last listed, notify is called with the changes.
+func (r *Repository) BackgroundFetch(ctx context.Context, notify func(RefChanges)) {
+	ticker := time.NewTicker(fetchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		if time.Since(r.lastFetch) >= fetchInterval {
+			if err := r.fetch(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Background fetch failed: %v", err)
+			}
+		}
+		changes := r.refChanges()
+		r.mu.Unlock()
+
+		if !changes.Empty() && notify != nil {
+			log.Printf("Curriculum updated: %s", changes)
+			notify(changes)
+		}
+	}
+}
+
+// refChanges compares the remote-tracking branches with the ones last listed, and drops the
+// cached branch list if they differ. Nothing is reported before the branches were listed.
+// r.mu must be held.
+func (r *Repository) refChanges() RefChanges {
+	var changes RefChanges
+	if r.refs == nil {
+		return changes
+	}
+	current, err := remoteBranches(r.repo)
+	if err != nil {
+		log.Printf("Error listing branches: %v", err)
+		return changes
+	}
+
+	for name, hash := range current {
+		old, ok := r.refs[name]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, name)
+		case old != hash:
+			changes.Updated = append(changes.Updated, name)
+		}
+	}
+	for name := range r.refs {
+		if _, ok := current[name]; !ok {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Updated)
+	sort.Strings(changes.Removed)
+
+	if !changes.Empty() {
+		r.refs = current
+		r.invalidateBranches()
+	}
+	return changes
+}
+
+// fetch fetches origin and records when it last succeeded. r.mu must be held.
+func (r *Repository) fetch(ctx context.Context) error {
+	if err := fetchRepo(ctx, r.repo); err != nil {
+		return err
+	}
+	r.lastFetch = time.Now()
+	return nil
+}
+
+// fetchIfNeeded fetches unless that was done recently; local origins are always fetched
+// because it is cheap. r.mu must be held.
+func (r *Repository) fetchIfNeeded(ctx context.Context) error {
+	if time.Since(r.lastFetch) < fetchInterval && !isLocalOrigin(r.repo) {
+		return nil
+	}
+	return r.fetch(ctx)
+}
+
+// Slides fetches origin and returns the slides of a branch. When fetching fails the slides
+// come from the local clone.
+func (r *Repository) Slides(ctx context.Context, branchName string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.fetch(ctx); err != nil && ctx.Err() != nil {
+		return "", err
+	}
+
+	content, err := readBranchFile(r.repo, branchName, "slides/slides.md")
+	if err != nil {
+		return "", fmt.Errorf("error reading slides: %v", err)
+	}
+	return content, nil
+}
+
+// Branches lists the stage branches with their descriptions and manifests, in curriculum
+// order. The list is cached for fetchInterval.
+func (r *Repository) Branches(ctx context.Context) ([]BranchInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.branchesAt) < fetchInterval && len(r.branches) > 0 && !r.branchesLocal {
+		return r.branches, nil
+	}
+
+	// Without the network the branches come from the local clone
+	if err := r.fetchIfNeeded(ctx); err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+
+	names, err := branchNames(ctx, r.repo)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog, err := readCatalog(r.repo, r.defaultBranch)
+	if err != nil {
+		log.Printf("Error reading stage catalog: %v", err)
+	}
+
+	var branchInfos []BranchInfo
+	for _, branchName := range names {
+		if utils.IsValidBranchName(branchName) {
+			description, _ := getBranchDescription(r.repo, branchName)
+			manifest, err := readManifest(r.repo, branchName)
+			if err != nil {
+				log.Printf("Error reading stage manifest: %v", err)
+			}
+			if manifest == nil {
+				if entry, ok := catalog[branchName]; ok {
+					manifest = &entry
+				}
+			}
+			branchInfos = append(branchInfos, BranchInfo{
+				Name:        branchName,
+				Description: description,
+				Manifest:    manifest,
+			})
+		}
+	}
+
+	SortBranches(branchInfos)
+
+	r.branches = branchInfos
+	r.branchesAt = time.Now()
+	r.branchesLocal = isLocalOrigin(r.repo)
+	if r.refs, err = remoteBranches(r.repo); err != nil {
+		log.Printf("Error listing branches: %v", err)
+	}
+	return branchInfos, nil
+}
+
+// invalidateBranches makes the next Branches list the branches again. r.mu must be held.
+func (r *Repository) invalidateBranches() {
+	r.branches = nil
+}
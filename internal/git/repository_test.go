@@ -0,0 +1,167 @@
+package git
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// newOrigin creates a curriculum repository with a main branch and the given stage
+// branches, each holding slides
+func newOrigin(t *testing.T, stages ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := git.PlainInitWithOptions(dir, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")},
+	})
+	if err != nil {
+		t.Fatalf("init origin: %v", err)
+	}
+	commitFile(t, repo, dir, "README.md", "# Curriculum\n")
+	for _, stage := range stages {
+		addStage(t, repo, dir, stage)
+	}
+	return dir
+}
+
+// addStage creates a stage branch off main in origin
+func addStage(t *testing.T, repo *git.Repository, dir, stage string) {
+	t.Helper()
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("worktree: %v", err)
+	}
+	branch := plumbing.NewBranchReferenceName(stage)
+	if err := w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("main")}); err != nil {
+		t.Fatalf("checkout main: %v", err)
+	}
+	if err := w.Checkout(&git.CheckoutOptions{Branch: branch, Create: true}); err != nil {
+		t.Fatalf("create %s: %v", stage, err)
+	}
+	commitFile(t, repo, dir, filepath.Join("slides", "slides.md"), "# "+stage+"\n")
+	commitFile(t, repo, dir, "main.tf", "# "+stage+"\n")
+}
+
+func commitFile(t *testing.T, repo *git.Repository, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("worktree: %v", err)
+	}
+	if _, err := w.Add(filepath.ToSlash(name)); err != nil {
+		t.Fatalf("add %s: %v", name, err)
+	}
+	sig := &object.Signature{Name: "test", Email: "test@localhost", When: time.Now()}
+	if _, err := w.Commit("Add "+name, &git.CommitOptions{Author: sig}); err != nil {
+		t.Fatalf("commit %s: %v", name, err)
+	}
+}
+
+// TestRepositoryConcurrentUse runs the background fetcher against everything the TUI does
+// with the clone at the same time; run it with -race
+func TestRepositoryConcurrentUse(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	interval := fetchInterval
+	fetchInterval = 10 * time.Millisecond
+	t.Cleanup(func() { fetchInterval = interval })
+
+	origin := newOrigin(t, "stage-1", "stage-2")
+	stagesDir := t.TempDir()
+	repoDir, err := EnsureNsfwctlRepo(context.Background(), origin, "main", filepath.Join(t.TempDir(), "infra"))
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	r, err := OpenRepository(repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Branches(context.Background()); err != nil {
+		t.Fatalf("branches: %v", err)
+	}
+
+	// A stage that appears upstream after the branches were listed
+	originRepo, err := git.PlainOpen(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addStage(t, originRepo, origin, "stage-3")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fetcherDone := make(chan struct{})
+	go func() {
+		defer close(fetcherDone)
+		r.BackgroundFetch(ctx, func(changes RefChanges) {
+			t.Logf("background fetch: %s", changes)
+		})
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for _, stage := range []string{"stage-1", "stage-2"} {
+		stage := stage
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if _, err := r.Branches(context.Background()); err != nil {
+					errs <- err
+				}
+				if _, err := r.Slides(context.Background(), stage); err != nil {
+					errs <- err
+				}
+				if _, err := r.EnsureStageWorktree(stagesDir, stage); err != nil {
+					errs <- err
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	cancel()
+	select {
+	case <-fetcherDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background fetch didn't stop when its context was cancelled")
+	}
+
+	branches, err := r.Branches(context.Background())
+	if err != nil {
+		t.Fatalf("branches: %v", err)
+	}
+	var names []string
+	for _, b := range branches {
+		names = append(names, b.Name)
+	}
+	if want := []string{"main", "stage-1", "stage-2", "stage-3"}; strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("branches = %v, want %v", names, want)
+	}
+	for _, stage := range []string{"stage-1", "stage-2"} {
+		content, err := os.ReadFile(filepath.Join(StageWorktreePath(stagesDir, stage), "main.tf"))
+		if err != nil || string(content) != "# "+stage+"\n" {
+			t.Errorf("worktree of %s has main.tf %q (%v)", stage, content, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package git
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+// StageWorktreePath returns the directory in stagesDir holding the worktree of a stage branch
+func StageWorktreePath(stagesDir, branchName string) string {
+	return filepath.Join(stagesDir, worktreeName(branchName))
+}
+
+// EnsureStageWorktree makes sure the stage branch has its own linked worktree and that it
+// is checked out at the branch's latest fetched commit. Untracked files such as terraform
+// state and the .terraform directory are left alone. The worktree is kept in stagesDir; its
+// directory is returned.
+func EnsureStageWorktree(repoPath, stagesDir, branchName string) (string, error) {
+	r, err := OpenRepository(repoPath)
+	if err != nil {
+		return "", err
+	}
+	return r.EnsureStageWorktree(stagesDir, branchName)
+}
+
+// EnsureStageWorktree is the package-level EnsureStageWorktree for the clone of r. No
+// fetch can move or prune the branch while it is checked out.
+func (r *Repository) EnsureStageWorktree(stagesDir, branchName string) (string, error) {
+	stagePath := StageWorktreePath(stagesDir, branchName)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ref, err := r.repo.Reference(plumbing.NewRemoteReferenceName("origin", branchName), true)
+	if err != nil {
+		return "", fmt.Errorf("error resolving branch %s: %v", branchName, err)
+	}
+
+	if !utils.FileExists(filepath.Join(stagePath, ".git")) {
+		if err := addWorktree(r.path, stagePath, branchName, ref.Hash()); err != nil {
+			return "", fmt.Errorf("error creating worktree for %s: %v", branchName, err)
+		}
+	}
+
+	stageRepo, err := git.PlainOpenWithOptions(stagePath, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+	if err != nil {
+		return "", fmt.Errorf("error opening worktree for %s: %v", branchName, err)
+	}
+
+	if err := checkoutTree(stageRepo, stagePath, ref.Hash()); err != nil {
+		return "", fmt.Errorf("error checking out branch: %v", err)
+	}
+
+	return stagePath, nil
+}
+
+// checkoutTree makes the tracked files in stagePath match commit hash, overwriting local
+// edits and removing files the commit no longer has, and points HEAD and the index at it.
+// A go-git checkout can't be used: it deletes every untracked file, terraform state included.
+func checkoutTree(stageRepo *git.Repository, stagePath string, hash plumbing.Hash) error {
+	commit, err := stageRepo.CommitObject(hash)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	if head, err := stageRepo.Head(); err == nil && head.Hash() != hash {
+		if old, err := stageRepo.CommitObject(head.Hash()); err == nil {
+			oldTree, err := old.Tree()
+			if err != nil {
+				return err
+			}
+			err = oldTree.Files().ForEach(func(f *object.File) error {
+				if _, err := tree.File(f.Name); err != object.ErrFileNotFound {
+					return nil
+				}
+				if err := os.Remove(filepath.Join(stagePath, filepath.FromSlash(f.Name))); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tree.Files().ForEach(func(f *object.File) error {
+		return writeTreeFile(stagePath, f)
+	})
+	if err != nil {
+		return err
+	}
+
+	w, err := stageRepo.Worktree()
+	if err != nil {
+		return fmt.Errorf("error getting worktree: %v", err)
+	}
+	return w.Reset(&git.ResetOptions{Commit: hash, Mode: git.MixedReset})
+}
+
+// writeTreeFile writes a file of a commit into the worktree in dir
+func writeTreeFile(dir string, f *object.File) error {
+	path := filepath.Join(dir, filepath.FromSlash(f.Name))
+	if err := utils.EnsureDirectory(filepath.Dir(path)); err != nil {
+		return err
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		return err
+	}
+
+	switch f.Mode {
+	case filemode.Symlink:
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(contents, path)
+	case filemode.Executable:
+		if err := os.WriteFile(path, []byte(contents), 0755); err != nil {
+			return err
+		}
+		return os.Chmod(path, 0755)
+	default:
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			return err
+		}
+		return os.Chmod(path, 0644)
+	}
+}
+
+// addWorktree lays out a linked worktree the same way `git worktree add --detach` does, so the
+// stage directory shares objects and refs with the main clone but has its own HEAD and index.
+func addWorktree(repoPath, stagePath, branchName string, hash plumbing.Hash) error {
+	adminDir := filepath.Join(repoPath, ".git", "worktrees", worktreeName(branchName))
+	if err := utils.EnsureDirectory(adminDir); err != nil {
+		return err
+	}
+	if err := utils.EnsureDirectory(stagePath); err != nil {
+		return err
+	}
+
+	files := map[string]string{
+		filepath.Join(adminDir, "commondir"): "../..\n",
+		filepath.Join(adminDir, "gitdir"):    filepath.Join(stagePath, ".git") + "\n",
+		filepath.Join(adminDir, "HEAD"):      hash.String() + "\n",
+		filepath.Join(stagePath, ".git"):     "gitdir: " + adminDir + "\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// worktreeName turns a branch name into a single directory name. Slashes and anything
+// else that isn't safe in a path are escaped, so no two branches share a directory.
+func worktreeName(branchName string) string {
+	return url.PathEscape(branchName)
+}
+
+// HeadCommit returns the commit checked out in a stage worktree
+func HeadCommit(stagePath string) (string, error) {
+	repo, err := git.PlainOpenWithOptions(stagePath, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+	if err != nil {
+		return "", fmt.Errorf("error opening worktree: %v", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", fmt.Errorf("error resolving HEAD: %v", err)
+	}
+	return head.Hash().String(), nil
+}
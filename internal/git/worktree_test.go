@@ -0,0 +1,81 @@
+package git
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// TestEnsureStageWorktreeKeepsUntrackedFiles moves a stage branch under a worktree that holds
+// terraform state
+func TestEnsureStageWorktreeKeepsUntrackedFiles(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	origin := newOrigin(t, "stage-1")
+	stagesDir := t.TempDir()
+	repoDir, err := EnsureNsfwctlRepo(context.Background(), origin, "main", filepath.Join(t.TempDir(), "infra"))
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	stagePath, err := EnsureStageWorktree(repoDir, stagesDir, "stage-1")
+	if err != nil {
+		t.Fatalf("worktree: %v", err)
+	}
+	untracked := []string{"terraform.tfstate", filepath.Join(".terraform", "terraform.tfstate")}
+	for _, name := range untracked {
+		path := filepath.Join(stagePath, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Upstream changes main.tf and drops the slides
+	originRepo, err := git.PlainOpen(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := originRepo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("stage-1")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Remove("slides/slides.md"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, originRepo, origin, "main.tf", "# stage-1, updated\n")
+
+	r, err := OpenRepository(repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Fetch(context.Background()); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if _, err := EnsureStageWorktree(repoDir, stagesDir, "stage-1"); err != nil {
+		t.Fatalf("worktree: %v", err)
+	}
+
+	for _, name := range untracked {
+		if _, err := os.Stat(filepath.Join(stagePath, name)); err != nil {
+			t.Errorf("untracked %s is gone: %v", name, err)
+		}
+	}
+	if content, err := os.ReadFile(filepath.Join(stagePath, "main.tf")); err != nil || string(content) != "# stage-1, updated\n" {
+		t.Errorf("main.tf = %q (%v), want the updated file", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(stagePath, "slides", "slides.md")); !os.IsNotExist(err) {
+		t.Errorf("slides.md was removed upstream but is still checked out (%v)", err)
+	}
+}
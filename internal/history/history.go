@@ -0,0 +1,183 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlgore/nsfwctl/internal/config"
+	"github.com/jlgore/nsfwctl/internal/git"
+	"github.com/jlgore/nsfwctl/internal/terraform"
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+// Outcomes of a recorded terraform operation
+const (
+	OutcomeSuccess   = "success"
+	OutcomeFailed    = "failed"
+	OutcomeCancelled = "cancelled"
+)
+
+// Entry is one terraform operation recorded in the ledger
+type Entry struct {
+	Time      time.Time      `json:"time"`
+	Operation string         `json:"operation"`
+	Branch    string         `json:"branch"`
+	Commit    string         `json:"commit,omitempty"`
+	Duration  time.Duration  `json:"duration"`
+	Resources map[string]int `json:"resources,omitempty"`
+	Outcome   string         `json:"outcome"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// maxErrorLength caps the error recorded with an entry; terraform can fail with pages of output
+const maxErrorLength = 8 << 10
+
+// maxLineLength is the longest ledger line Load reads, leaving room for entries written
+// before errors were capped
+const maxLineLength = 1 << 20
+
+var ledgerMux sync.Mutex
+
+// GetLedgerFilePath returns the path to the deployment ledger
+func GetLedgerFilePath() (string, error) {
+	dataDir, err := config.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "history.jsonl"), nil
+}
+
+// Record appends an entry to the ledger, cutting a long error short
+func Record(entry Entry) error {
+	ledgerMux.Lock()
+	defer ledgerMux.Unlock()
+
+	path, err := GetLedgerFilePath()
+	if err != nil {
+		return err
+	}
+	if err := utils.EnsureDirectory(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("error creating app directory: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening ledger: %v", err)
+	}
+	defer file.Close()
+
+	entry.Error = utils.TruncateString(entry.Error, maxErrorLength)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding ledger entry: %v", err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing ledger: %v", err)
+	}
+	return nil
+}
+
+// RecordOperation adds a terraform operation on branch, run in the stage worktree in stagePath
+// from started until now, to the ledger and returns the entry. plan is the plan it made or
+// applied, if any; a failed operation has err set, and cancelled tells a cancellation apart
+// from a failure. Errors writing the ledger are logged rather than failing the operation.
+func RecordOperation(operation, branch, stagePath string, started time.Time, plan *terraform.PlanSummary, err error, cancelled bool) Entry {
+	entry := Entry{
+		Time:      started,
+		Operation: operation,
+		Branch:    branch,
+		Duration:  time.Since(started),
+		Outcome:   OutcomeSuccess,
+	}
+	if commit, err := git.HeadCommit(stagePath); err == nil {
+		entry.Commit = commit
+	}
+	if plan != nil {
+		entry.Resources = plan.Counts()
+	}
+	switch {
+	case cancelled:
+		entry.Outcome = OutcomeCancelled
+	case err != nil:
+		entry.Outcome = OutcomeFailed
+		entry.Error = err.Error()
+	}
+
+	if err := Record(entry); err != nil {
+		log.Printf("Error recording %s of %s in the ledger: %v", operation, branch, err)
+	}
+	return entry
+}
+
+// Load returns every entry in the ledger, oldest first
+func Load() ([]Entry, error) {
+	ledgerMux.Lock()
+	defer ledgerMux.Unlock()
+
+	path, err := GetLedgerFilePath()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening ledger: %v", err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxLineLength)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("error decoding ledger line %d: %v", lineNo, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading ledger: %v", err)
+	}
+	return entries, nil
+}
+
+// String formats the entry as a single line for listings
+func (e Entry) String() string {
+	commit := e.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	if commit == "" {
+		commit = "-"
+	}
+
+	line := fmt.Sprintf("%s  %-13s  %-20s  %-7s  %6s  %-9s",
+		e.Time.Local().Format("2006-01-02 15:04:05"),
+		e.Operation,
+		utils.TruncateString(e.Branch, 20),
+		commit,
+		utils.FormatDuration(e.Duration),
+		e.Outcome,
+	)
+	if len(e.Resources) > 0 {
+		line += fmt.Sprintf("  +%d ~%d ±%d -%d",
+			e.Resources["create"], e.Resources["update"], e.Resources["replace"], e.Resources["delete"])
+	}
+	if e.Error != "" {
+		line += "  " + utils.TruncateString(strings.SplitN(e.Error, "\n", 2)[0], 60)
+	}
+	return line
+}
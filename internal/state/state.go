@@ -0,0 +1,102 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jlgore/nsfwctl/internal/config"
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+// Deployment records a stage that is currently deployed
+type Deployment struct {
+	Branch     string    `json:"branch"`
+	DeployedAt time.Time `json:"deployed_at"`
+}
+
+var stateMux sync.Mutex
+
+// GetStateFilePath returns the path to the file tracking deployed stages
+func GetStateFilePath() (string, error) {
+	dataDir, err := config.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "deployments.json"), nil
+}
+
+// Deployed returns the currently deployed stages keyed by branch name
+func Deployed() (map[string]Deployment, error) {
+	stateMux.Lock()
+	defer stateMux.Unlock()
+	return load()
+}
+
+// MarkDeployed records that a stage has been applied
+func MarkDeployed(branch string) error {
+	stateMux.Lock()
+	defer stateMux.Unlock()
+
+	deployments, err := load()
+	if err != nil {
+		return err
+	}
+	deployments[branch] = Deployment{Branch: branch, DeployedAt: time.Now()}
+	return save(deployments)
+}
+
+// MarkDestroyed records that a stage has been torn down
+func MarkDestroyed(branch string) error {
+	stateMux.Lock()
+	defer stateMux.Unlock()
+
+	deployments, err := load()
+	if err != nil {
+		return err
+	}
+	delete(deployments, branch)
+	return save(deployments)
+}
+
+func load() (map[string]Deployment, error) {
+	deployments := make(map[string]Deployment)
+
+	path, err := GetStateFilePath()
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return deployments, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading deployment state: %v", err)
+	}
+	if err := json.Unmarshal(content, &deployments); err != nil {
+		return nil, fmt.Errorf("error decoding deployment state: %v", err)
+	}
+	return deployments, nil
+}
+
+func save(deployments map[string]Deployment) error {
+	path, err := GetStateFilePath()
+	if err != nil {
+		return err
+	}
+	if err := utils.EnsureDirectory(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("error creating app directory: %v", err)
+	}
+
+	content, err := json.MarshalIndent(deployments, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding deployment state: %v", err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("error writing deployment state: %v", err)
+	}
+	return nil
+}
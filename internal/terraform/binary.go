@@ -0,0 +1,233 @@
+package terraform
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/hc-install/product"
+	"github.com/hashicorp/hc-install/releases"
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+// DefaultTerraformVersion is the terraform version installed when no usable binary is configured
+const DefaultTerraformVersion = "1.9.5"
+
+// BinaryOptions describes how to find or install the terraform executable
+type BinaryOptions struct {
+	// Path is a path to the terraform executable, or a name to look up in PATH
+	Path string
+	// Version is the pinned version to install when Path can't be used
+	Version string
+	// InstallDir is where terraform gets installed, defaulting to ~/.nsfwctl/bin. Each
+	// version goes into its own terraform_<version> folder.
+	InstallDir string
+	// Archive is a pre-seeded release zip to install from in offline mode,
+	// defaulting to terraform_<version>_<os>_<arch>.zip in InstallDir. The release's
+	// terraform_<version>_SHA256SUMS must be next to it.
+	Archive string
+	// Offline disables downloading terraform from releases.hashicorp.com
+	Offline bool
+}
+
+var (
+	binaryOptions = BinaryOptions{Path: "terraform"}
+	resolvedPath  string
+	resolveMux    sync.Mutex
+)
+
+// SetBinaryOptions sets how terraform commands locate the terraform executable
+func SetBinaryOptions(opts BinaryOptions) {
+	resolveMux.Lock()
+	defer resolveMux.Unlock()
+	binaryOptions = opts
+	resolvedPath = ""
+}
+
+// ResolveBinary returns the path of the terraform executable, installing it if needed.
+// The configured path is tried first, then a previous install of the pinned version in the
+// install directory, then the pre-seeded archive (offline) or a download (online).
+func ResolveBinary(ctx context.Context, opts BinaryOptions) (string, error) {
+	if opts.Path != "" {
+		path, err := lookPath(opts.Path)
+		if err == nil {
+			return path, nil
+		}
+		log.Printf("Configured terraform path %q not usable: %v", opts.Path, err)
+	}
+
+	if opts.Version == "" {
+		opts.Version = DefaultTerraformVersion
+	}
+	v, err := version.NewVersion(opts.Version)
+	if err != nil {
+		return "", fmt.Errorf("invalid terraform version %q: %v", opts.Version, err)
+	}
+
+	if opts.InstallDir == "" {
+		appDir, err := utils.GetAppDir()
+		if err != nil {
+			return "", fmt.Errorf("error getting app directory: %v", err)
+		}
+		opts.InstallDir = filepath.Join(appDir, "bin")
+	}
+	versionDir := filepath.Join(opts.InstallDir, "terraform_"+v.String())
+	if err := utils.EnsureDirectory(versionDir); err != nil {
+		return "", fmt.Errorf("error creating install directory: %v", err)
+	}
+
+	installed := filepath.Join(versionDir, product.Terraform.BinaryName())
+	if isExecutable(installed) {
+		return installed, nil
+	}
+
+	if opts.Offline {
+		archive := opts.Archive
+		if archive == "" {
+			archive = filepath.Join(opts.InstallDir, fmt.Sprintf("terraform_%s_%s_%s.zip", v, runtime.GOOS, runtime.GOARCH))
+		}
+		log.Printf("Installing terraform from archive %s", archive)
+		sums := filepath.Join(filepath.Dir(archive), fmt.Sprintf("terraform_%s_SHA256SUMS", v))
+		if err := verifyChecksum(archive, sums); err != nil {
+			return "", fmt.Errorf("error installing terraform from %s: %v", archive, err)
+		}
+		if err := extractBinary(archive, installed); err != nil {
+			return "", fmt.Errorf("error installing terraform from %s: %v", archive, err)
+		}
+		return installed, nil
+	}
+
+	log.Printf("Installing terraform %s into %s", v, versionDir)
+	installer := &releases.ExactVersion{
+		Product:    product.Terraform,
+		Version:    v,
+		InstallDir: versionDir,
+	}
+	path, err := installer.Install(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error installing terraform %s: %v", v, err)
+	}
+	return path, nil
+}
+
+// newTerraform creates a Terraform object for workingDir using the resolved terraform executable
+func newTerraform(ctx context.Context, workingDir string) (*tfexec.Terraform, error) {
+	resolveMux.Lock()
+	if resolvedPath == "" {
+		path, err := ResolveBinary(ctx, binaryOptions)
+		if err != nil {
+			resolveMux.Unlock()
+			return nil, err
+		}
+		log.Printf("Terraform executable found at: %s", path)
+		resolvedPath = path
+	}
+	execPath := resolvedPath
+	resolveMux.Unlock()
+
+	tf, err := tfexec.NewTerraform(workingDir, execPath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Terraform object: %v", err)
+	}
+	return tf, nil
+}
+
+func lookPath(path string) (string, error) {
+	if !strings.ContainsRune(path, filepath.Separator) {
+		return exec.LookPath(path)
+	}
+	if !isExecutable(path) {
+		return "", fmt.Errorf("%s is not an executable file", path)
+	}
+	return path, nil
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	return runtime.GOOS == "windows" || info.Mode()&0111 != 0
+}
+
+// verifyChecksum checks archive against its entry in a release's SHA256SUMS file
+func verifyChecksum(archive, sumsFile string) error {
+	sums, err := os.ReadFile(sumsFile)
+	if err != nil {
+		return fmt.Errorf("error reading checksums: %v", err)
+	}
+	var want string
+	for _, line := range strings.Split(string(sums), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == filepath.Base(archive) {
+			want = fields[0]
+			break
+		}
+	}
+	if want == "" {
+		return fmt.Errorf("%s has no checksum for %s", sumsFile, filepath.Base(archive))
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch: got %s, want %s", got, want)
+	}
+	return nil
+}
+
+// extractBinary copies the terraform executable out of a release zip to dest
+func extractBinary(archive, dest string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name != product.Terraform.BinaryName() {
+			continue
+		}
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		tmp := dest + ".tmp"
+		out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, src); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+		if err := out.Close(); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return os.Rename(tmp, dest)
+	}
+	return fmt.Errorf("archive does not contain %s", product.Terraform.BinaryName())
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package terraform
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// interruptOnCancel makes cancelling cmd send it an interrupt. cmd gets its own process
+// group so a Ctrl+C in the terminal doesn't reach it as well: a second interrupt makes
+// terraform exit without saving its state.
+func interruptOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package terraform
+
+import "os/exec"
+
+// interruptOnCancel leaves cmd to be killed on cancel: Windows can't deliver interrupts
+func interruptOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,147 @@
+package terraform
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// PlanFileName is the name of the saved plan file written into the working directory
+const PlanFileName = "nsfwctl.tfplan"
+
+// Change actions reported in a PlanSummary
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionReplace = "replace"
+	ActionDelete  = "delete"
+)
+
+// PlanActions lists the change actions in the order they should be displayed
+var PlanActions = []string{ActionCreate, ActionUpdate, ActionReplace, ActionDelete}
+
+// actionSymbols are the markers terraform puts in front of a resource in a plan
+var actionSymbols = map[string]string{
+	ActionCreate:  "+",
+	ActionUpdate:  "~",
+	ActionReplace: "-/+",
+	ActionDelete:  "-",
+}
+
+// NoChanges is what a plan without resource changes reads as
+const NoChanges = "No changes. Your infrastructure matches the configuration."
+
+// ResourceChange is a single resource affected by a plan
+type ResourceChange struct {
+	Address string `json:"address"`
+	Type    string `json:"type"`
+	Action  string `json:"action"`
+}
+
+// String formats the change as a line of a plan, marked the way terraform marks it
+func (c ResourceChange) String() string {
+	return fmt.Sprintf("%3s %s", actionSymbols[c.Action], c.Address)
+}
+
+// PlanSummary holds the resource changes of a saved plan
+type PlanSummary struct {
+	PlanFile string           `json:"plan_file"`
+	Changes  []ResourceChange `json:"changes"`
+}
+
+// Count returns the number of resource changes with the given action
+func (s *PlanSummary) Count(action string) int {
+	count := 0
+	for _, c := range s.Changes {
+		if c.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+// CountText describes the number of resource changes with the given action, e.g. "2 to create"
+func (s *PlanSummary) CountText(action string) string {
+	return fmt.Sprintf("%d to %s", s.Count(action), action)
+}
+
+// Counts returns the number of resource changes for every action
+func (s *PlanSummary) Counts() map[string]int {
+	counts := make(map[string]int, len(PlanActions))
+	for _, action := range PlanActions {
+		counts[action] = s.Count(action)
+	}
+	return counts
+}
+
+// ByAction returns the resource changes with the given action
+func (s *PlanSummary) ByAction(action string) []ResourceChange {
+	var changes []ResourceChange
+	for _, c := range s.Changes {
+		if c.Action == action {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// HasChanges reports whether the plan changes any resources
+func (s *PlanSummary) HasChanges() bool {
+	return len(s.Changes) > 0
+}
+
+// WriteText writes the plan as plain text: a line of counts, then every resource change
+func (s *PlanSummary) WriteText(w io.Writer) {
+	if !s.HasChanges() {
+		fmt.Fprintln(w, NoChanges)
+		return
+	}
+
+	var counts []string
+	for _, action := range PlanActions {
+		counts = append(counts, s.CountText(action))
+	}
+	fmt.Fprintf(w, "Plan: %s.\n", strings.Join(counts, ", "))
+	for _, action := range PlanActions {
+		for _, c := range s.ByAction(action) {
+			fmt.Fprintf(w, "  %s\n", c)
+		}
+	}
+}
+
+func summarizePlan(planFile string, plan *tfjson.Plan) *PlanSummary {
+	summary := &PlanSummary{PlanFile: planFile}
+	for _, rc := range plan.ResourceChanges {
+		if rc.Change == nil {
+			continue
+		}
+		action := changeAction(rc.Change.Actions)
+		if action == "" {
+			continue
+		}
+		summary.Changes = append(summary.Changes, ResourceChange{
+			Address: rc.Address,
+			Type:    rc.Type,
+			Action:  action,
+		})
+	}
+	return summary
+}
+
+func changeAction(actions tfjson.Actions) string {
+	switch {
+	case actions.Replace():
+		return ActionReplace
+	case actions.Create():
+		return ActionCreate
+	case actions.Update():
+		return ActionUpdate
+	case actions.Delete():
+		return ActionDelete
+	default:
+		// No-op and read actions don't change anything
+		return ""
+	}
+}
@@ -2,29 +2,34 @@ package terraform
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/terraform-exec/tfexec"
 )
 
-// InitTerraform initializes Terraform in the given directory
-func InitTerraform(repoPath string) (string, error) {
-	log.Printf("Starting Terraform init process in: %s", repoPath)
+// interruptTimeout is how long an interrupted apply or destroy gets to finish what it is
+// doing and save its state before it is killed
+const interruptTimeout = 5 * time.Minute
 
-	terraformPath, err := exec.LookPath("terraform")
-	if err != nil {
-		return "", fmt.Errorf("terraform not found in PATH: %v", err)
-	}
-	log.Printf("Terraform executable found at: %s", terraformPath)
+// ErrStalePlan is returned when a saved plan can't be applied because the state changed
+// since it was made; the stage has to be planned again
+var ErrStalePlan = errors.New("the saved plan is stale, the state changed since it was made")
+
+// InitTerraform initializes Terraform in the given directory, streaming its output to output if it is not nil
+func InitTerraform(ctx context.Context, repoPath string, output io.Writer) (string, error) {
+	log.Printf("Starting Terraform init process in: %s", repoPath)
 
-	tf, err := tfexec.NewTerraform(repoPath, terraformPath)
+	tf, err := newTerraform(ctx, repoPath)
 	if err != nil {
-		return "", fmt.Errorf("error creating Terraform object: %v", err)
+		return "", err
 	}
 
 	logFile := filepath.Join(repoPath, "terraform-init.log")
@@ -36,12 +41,10 @@ func InitTerraform(repoPath string) (string, error) {
 
 	tf.SetLogger(log.New(f, "", log.Ldate|log.Ltime))
 
-	var stdout, stderr strings.Builder
-	tf.SetStdout(&stdout)
-	tf.SetStderr(&stderr)
+	stdout, stderr := captureOutput(tf, output)
 
 	log.Println("Running Terraform init...")
-	err = tf.Init(context.Background(), tfexec.Upgrade(true), tfexec.Reconfigure(true))
+	err = tf.Init(ctx, tfexec.Upgrade(true), tfexec.Reconfigure(true))
 	if err != nil {
 		log.Printf("Error running terraform init: %v", err)
 		return "", fmt.Errorf("error running terraform init: %v\nStderr: %s", err, stderr.String())
@@ -86,42 +89,103 @@ func formatTerraformOutput(repoPath, stdout, stderr string) (string, error) {
 	return output.String(), nil
 }
 
-// PlanTerraform runs terraform plan and returns the plan output
-func PlanTerraform(repoPath string) (string, error) {
-	tf, err := tfexec.NewTerraform(repoPath, "terraform")
+// PlanTerraform runs terraform plan, saving the plan to a file, and returns a summary of its changes
+func PlanTerraform(ctx context.Context, repoPath string, output io.Writer) (*PlanSummary, error) {
+	log.Println("Running Terraform plan...")
+	return planTerraform(ctx, repoPath, false, output)
+}
+
+// ApplyTerraform applies the plan saved in planFile, so exactly the changes that were reviewed
+// are made. It returns ErrStalePlan when the plan can't be applied anymore.
+func ApplyTerraform(ctx context.Context, repoPath, planFile string, output io.Writer) (string, error) {
+	tf, err := newTerraform(ctx, repoPath)
 	if err != nil {
-		return "", fmt.Errorf("error creating Terraform object: %v", err)
+		return "", err
 	}
 
-	var stdout, stderr strings.Builder
-	tf.SetStdout(&stdout)
-	tf.SetStderr(&stderr)
+	log.Println("Running Terraform apply...")
+	return runInterruptible(ctx, tf, output, "apply", planFile)
+}
 
-	log.Println("Running Terraform plan...")
-	_, err = tf.Plan(context.Background())
+// PlanDestroyTerraform runs terraform plan -destroy and returns a summary of its changes
+func PlanDestroyTerraform(ctx context.Context, repoPath string, output io.Writer) (*PlanSummary, error) {
+	log.Println("Running Terraform destroy plan...")
+	return planTerraform(ctx, repoPath, true, output)
+}
+
+func planTerraform(ctx context.Context, repoPath string, destroy bool, output io.Writer) (*PlanSummary, error) {
+	tf, err := newTerraform(ctx, repoPath)
 	if err != nil {
-		return "", fmt.Errorf("error running terraform plan: %v\nStderr: %s", err, stderr.String())
+		return nil, err
 	}
 
-	return stdout.String(), nil
+	_, stderr := captureOutput(tf, output)
+
+	planFile := filepath.Join(repoPath, PlanFileName)
+	_, err = tf.Plan(ctx, tfexec.Out(planFile), tfexec.Destroy(destroy))
+	if err != nil {
+		return nil, fmt.Errorf("error running terraform plan: %v\nStderr: %s", err, stderr.String())
+	}
+
+	// terraform show prints the whole plan as JSON, which is no use in the streamed output
+	tf.SetStdout(nil)
+	plan, err := tf.ShowPlanFile(ctx, planFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan file: %v", err)
+	}
+
+	return summarizePlan(planFile, plan), nil
 }
 
-// ApplyTerraform runs terraform apply
-func ApplyTerraform(repoPath string) (string, error) {
-	tf, err := tfexec.NewTerraform(repoPath, "terraform")
+// DestroyTerraform applies the destroy plan saved in planFile, so exactly the resources that
+// were reviewed are destroyed. It returns ErrStalePlan when the plan can't be applied anymore.
+func DestroyTerraform(ctx context.Context, repoPath, planFile string, output io.Writer) (string, error) {
+	tf, err := newTerraform(ctx, repoPath)
 	if err != nil {
-		return "", fmt.Errorf("error creating Terraform object: %v", err)
+		return "", err
 	}
 
+	log.Println("Running Terraform destroy...")
+	return runInterruptible(ctx, tf, output, "apply", planFile)
+}
+
+// captureOutput records stdout and stderr of every command run by tf, copying both to output if it is not nil
+func captureOutput(tf *tfexec.Terraform, output io.Writer) (*strings.Builder, *strings.Builder) {
 	var stdout, stderr strings.Builder
-	tf.SetStdout(&stdout)
-	tf.SetStderr(&stderr)
+	if output == nil {
+		tf.SetStdout(&stdout)
+		tf.SetStderr(&stderr)
+	} else {
+		tf.SetStdout(io.MultiWriter(&stdout, output))
+		tf.SetStderr(io.MultiWriter(&stderr, output))
+	}
+	return &stdout, &stderr
+}
 
-	log.Println("Running Terraform apply...")
-	err = tf.Apply(context.Background())
-	if err != nil {
-		return "", fmt.Errorf("error running terraform apply: %v\nStderr: %s", err, stderr.String())
+// runInterruptible runs a terraform command that changes infrastructure and returns its
+// output. When ctx is done terraform gets an interrupt, so it can finish the operations in
+// flight and save its state, and it is only killed if it hasn't exited after interruptTimeout.
+// tfexec can't be used for this: it stops reading the output on cancel, and terraform dies
+// of a broken pipe as soon as it reports the interrupt.
+func runInterruptible(ctx context.Context, tf *tfexec.Terraform, output io.Writer, command string, args ...string) (string, error) {
+	var stdout, stderr strings.Builder
+	cmd := exec.CommandContext(ctx, tf.ExecPath(),
+		append([]string{command, "-no-color", "-auto-approve", "-input=false"}, args...)...)
+	cmd.Dir = tf.WorkingDir()
+	cmd.Env = append(os.Environ(), "TF_IN_AUTOMATION=1", "TF_LOG=", "TF_LOG_PATH=")
+	if output == nil {
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	} else {
+		cmd.Stdout, cmd.Stderr = io.MultiWriter(&stdout, output), io.MultiWriter(&stderr, output)
 	}
+	interruptOnCancel(cmd)
+	cmd.WaitDelay = interruptTimeout
 
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "Saved plan is stale") {
+			return "", ErrStalePlan
+		}
+		return "", fmt.Errorf("error running terraform %s: %v\nStderr: %s", command, err, stderr.String())
+	}
 	return stdout.String(), nil
 }
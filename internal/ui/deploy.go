@@ -0,0 +1,272 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/jlgore/nsfwctl/internal/config"
+	"github.com/jlgore/nsfwctl/internal/git"
+	"github.com/jlgore/nsfwctl/internal/history"
+	"github.com/jlgore/nsfwctl/internal/state"
+	"github.com/jlgore/nsfwctl/internal/terraform"
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+type terraformInitMsg struct{ output string }
+type terraformPlanMsg struct{ summary *terraform.PlanSummary }
+type terraformApplyMsg struct{ output string }
+type terraformDestroyPlanMsg struct{ summary *terraform.PlanSummary }
+type terraformDestroyMsg struct{ output string }
+type terraformErrMsg struct {
+	step string
+	err  error
+}
+type terraformCancelledMsg struct {
+	step    string
+	elapsed time.Duration
+}
+
+// terraformLogMsg carries one line of terraform output and the channel it was read from
+type terraformLogMsg struct {
+	line  string
+	lines <-chan string
+}
+
+// logWriter splits everything written to it into lines and sends them on a channel.
+// terraform-exec copies stdout and stderr from separate goroutines, so writes are locked.
+type logWriter struct {
+	mu    sync.Mutex
+	buf   []byte
+	lines chan string
+}
+
+func newLogWriter() *logWriter {
+	return &logWriter{lines: make(chan string, 64)}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.lines <- strings.TrimRight(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close sends any unterminated last line and closes the channel
+func (w *logWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.lines <- string(w.buf)
+		w.buf = nil
+	}
+	close(w.lines)
+	return nil
+}
+
+func waitForLogLine(lines <-chan string) tea.Cmd {
+	return func() tea.Msg {
+		line, ok := <-lines
+		if !ok {
+			return nil
+		}
+		return terraformLogMsg{line: line, lines: lines}
+	}
+}
+
+// stepFunc runs one terraform command, writing its output to w, and returns the resulting message
+type stepFunc func(ctx context.Context, w io.Writer) tea.Msg
+
+// runStep switches to the deploying state and starts a terraform step, streaming its output into the log pane.
+// The step can be interrupted through m.cancel; an apply or destroy gets time to stop cleanly before it is killed.
+func (m Model) runStep(step, status string, run stepFunc) (Model, tea.Cmd) {
+	cmds := []tea.Cmd{}
+	if m.state != StateDeploying {
+		cmds = append(cmds, m.spinner.Tick)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newLogWriter()
+	m.cancel = cancel
+	m.state = StateDeploying
+	m.deployStep = step
+	m.status = status
+	m.stepStarted = time.Now()
+	m.logLines = append(m.logLines, fmt.Sprintf("$ terraform %s", step))
+	m.viewport.SetContent(strings.Join(m.logLines, "\n"))
+	m.viewport.GotoBottom()
+
+	started := m.stepStarted
+	branch, stagePath, lastPlan := m.selectedBranch, m.stagePath, m.lastPlan
+	cmds = append(cmds, func() tea.Msg {
+		defer cancel()
+		defer w.Close()
+		msg := run(ctx, w)
+		if _, failed := msg.(terraformErrMsg); failed && ctx.Err() == context.Canceled {
+			log.Printf("Terraform %s cancelled after %s", step, utils.FormatDuration(time.Since(started)))
+			msg = terraformCancelledMsg{step: step, elapsed: time.Since(started)}
+		}
+		recordStep(step, branch, stagePath, started, lastPlan, msg)
+		return msg
+	}, waitForLogLine(w.lines))
+	return m, tea.Batch(cmds...)
+}
+
+// recordStep adds the outcome of a terraform step to the deployment ledger. Applies and
+// destroys are recorded with the resource counts of the plan that was confirmed.
+func recordStep(step, branch, stagePath string, started time.Time, lastPlan *terraform.PlanSummary, msg tea.Msg) {
+	var (
+		plan      *terraform.PlanSummary
+		err       error
+		cancelled bool
+	)
+	switch msg := msg.(type) {
+	case terraformPlanMsg:
+		plan = msg.summary
+	case terraformDestroyPlanMsg:
+		plan = msg.summary
+	case terraformApplyMsg, terraformDestroyMsg:
+		plan = lastPlan
+	case terraformCancelledMsg:
+		cancelled = true
+	case terraformErrMsg:
+		err = msg.err
+	}
+	history.RecordOperation(step, branch, stagePath, started, plan, err, cancelled)
+}
+
+// startDeploy begins the init, plan and apply pipeline for a stage
+func (m Model) startDeploy(branch string) (Model, tea.Cmd) {
+	stagesDir, err := config.StagesDir()
+	if err != nil {
+		m.err = err
+		return m, nil
+	}
+	m.selectedBranch = branch
+	m.stagePath = git.StageWorktreePath(stagesDir, branch)
+	m.teardown = false
+	m.err = nil
+	return m.runStep("init", fmt.Sprintf("Running terraform init for %s...", branch), terraformInitStep(m.repoPath, stagesDir, branch))
+}
+
+func terraformInitStep(repoPath, stagesDir, branchName string) stepFunc {
+	return func(ctx context.Context, w io.Writer) tea.Msg {
+		// Slides are read straight from git objects, so the stage worktree is only checked out here
+		stagePath, err := git.EnsureStageWorktree(repoPath, stagesDir, branchName)
+		if err != nil {
+			log.Printf("Checkout of %s failed: %v", branchName, err)
+			return terraformErrMsg{step: "checkout", err: err}
+		}
+		fmt.Fprintf(w, "Checked out %s in %s\n", branchName, stagePath)
+
+		output, err := terraform.InitTerraform(ctx, stagePath, w)
+		if err != nil {
+			log.Printf("Terraform init failed: %v", err)
+			return terraformErrMsg{step: "init", err: err}
+		}
+		return terraformInitMsg{output}
+	}
+}
+
+func terraformPlanStep(repoPath string) stepFunc {
+	return func(ctx context.Context, w io.Writer) tea.Msg {
+		summary, err := terraform.PlanTerraform(ctx, repoPath, w)
+		if err != nil {
+			log.Printf("Terraform plan failed: %v", err)
+			return terraformErrMsg{step: "plan", err: err}
+		}
+		return terraformPlanMsg{summary}
+	}
+}
+
+func terraformApplyStep(repoPath, branchName, planFile string) stepFunc {
+	return func(ctx context.Context, w io.Writer) tea.Msg {
+		output, err := terraform.ApplyTerraform(ctx, repoPath, planFile, w)
+		if err != nil {
+			log.Printf("Terraform apply failed: %v", err)
+			return terraformErrMsg{step: "apply", err: err}
+		}
+		if err := state.MarkDeployed(branchName); err != nil {
+			log.Printf("Error recording deployment of %s: %v", branchName, err)
+		}
+		return terraformApplyMsg{output}
+	}
+}
+
+func terraformDestroyPlanStep(repoPath string) stepFunc {
+	return func(ctx context.Context, w io.Writer) tea.Msg {
+		summary, err := terraform.PlanDestroyTerraform(ctx, repoPath, w)
+		if err != nil {
+			log.Printf("Terraform destroy plan failed: %v", err)
+			return terraformErrMsg{step: "plan -destroy", err: err}
+		}
+		return terraformDestroyPlanMsg{summary}
+	}
+}
+
+func terraformDestroyStep(repoPath, branchName, planFile string) stepFunc {
+	return func(ctx context.Context, w io.Writer) tea.Msg {
+		output, err := terraform.DestroyTerraform(ctx, repoPath, planFile, w)
+		if err != nil {
+			log.Printf("Terraform destroy failed: %v", err)
+			return terraformErrMsg{step: "destroy", err: err}
+		}
+		if err := state.MarkDestroyed(branchName); err != nil {
+			log.Printf("Error recording teardown of %s: %v", branchName, err)
+		}
+		return terraformDestroyMsg{output}
+	}
+}
+
+var (
+	actionStyles = map[string]lipgloss.Style{
+		terraform.ActionCreate:  lipgloss.NewStyle().Foreground(lipgloss.Color("10")),
+		terraform.ActionUpdate:  lipgloss.NewStyle().Foreground(lipgloss.Color("11")),
+		terraform.ActionReplace: lipgloss.NewStyle().Foreground(lipgloss.Color("13")),
+		terraform.ActionDelete:  lipgloss.NewStyle().Foreground(lipgloss.Color("9")),
+	}
+	sectionStyle = lipgloss.NewStyle().Bold(true)
+)
+
+// renderPlanSummary lists the plan's resource changes grouped by action
+func renderPlanSummary(summary *terraform.PlanSummary) string {
+	if !summary.HasChanges() {
+		return terraform.NoChanges
+	}
+
+	var counts []string
+	for _, action := range terraform.PlanActions {
+		counts = append(counts, actionStyles[action].Render(summary.CountText(action)))
+	}
+
+	var b strings.Builder
+	b.WriteString(sectionStyle.Render("Plan: ") + strings.Join(counts, ", ") + "\n")
+	for _, action := range terraform.PlanActions {
+		changes := summary.ByAction(action)
+		if len(changes) == 0 {
+			continue
+		}
+		b.WriteString("\n" + sectionStyle.Render(fmt.Sprintf("%s (%d)", strings.ToUpper(action[:1])+action[1:], len(changes))) + "\n")
+		for _, c := range changes {
+			b.WriteString(actionStyles[action].Render("  "+c.String()) + "\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,169 @@
+package ui
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/fsnotify/fsnotify"
+	"github.com/jlgore/nsfwctl/pkg/utils"
+)
+
+// Where dev mode looks for the slides of a stage folder, in order of preference
+var devSlideFiles = []string{filepath.Join("slides", "slides.md"), "slides.md"}
+
+// DevModel shows the slides of a local stage folder and reloads them whenever the file
+// changes, for writing slides without committing and pushing them
+type DevModel struct {
+	path       string
+	watcher    *fsnotify.Watcher
+	slideModel SlideModel
+	reloaded   time.Time
+	err        error
+}
+
+type slidesChangedMsg struct{}
+type watchErrMsg struct{ err error }
+
+// findSlides returns the slides file of a stage folder
+func findSlides(dir string) (string, error) {
+	for _, name := range devSlideFiles {
+		path := filepath.Join(dir, name)
+		if utils.FileExists(path) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no slides in %s (expected slides/slides.md or slides.md)", dir)
+}
+
+// NewDevModel loads the slides in path and starts watching them
+func NewDevModel(path string) (DevModel, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return DevModel{}, fmt.Errorf("error reading slides: %v", err)
+	}
+	slideModel, err := NewSlideModel(string(content))
+	if err != nil {
+		return DevModel{}, err
+	}
+	slideModel.hint = ""
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return DevModel{}, fmt.Errorf("error creating file watcher: %v", err)
+	}
+	// Editors often save by writing a new file and renaming it over the old one, which
+	// only the folder sees
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return DevModel{}, fmt.Errorf("error watching %s: %v", filepath.Dir(path), err)
+	}
+
+	return DevModel{
+		path:       path,
+		watcher:    watcher,
+		slideModel: slideModel,
+		reloaded:   time.Now(),
+	}, nil
+}
+
+func (m DevModel) Init() tea.Cmd {
+	return m.waitForChange()
+}
+
+// waitForChange blocks until the slides file is written, created or replaced
+func (m DevModel) waitForChange() tea.Cmd {
+	return func() tea.Msg {
+		for {
+			select {
+			case event, ok := <-m.watcher.Events:
+				if !ok {
+					return nil
+				}
+				if filepath.Clean(event.Name) == m.path && event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					return slidesChangedMsg{}
+				}
+			case err, ok := <-m.watcher.Errors:
+				if !ok {
+					return nil
+				}
+				return watchErrMsg{err}
+			}
+		}
+	}
+}
+
+func (m DevModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c", "q", "esc":
+			return m, tea.Quit
+		}
+	case slidesChangedMsg:
+		content, err := os.ReadFile(m.path)
+		if err != nil {
+			// The file is briefly missing while an editor replaces it; the next event reloads it
+			if !os.IsNotExist(err) {
+				m.err = fmt.Errorf("error reading slides: %v", err)
+			}
+			return m, m.waitForChange()
+		}
+		m.slideModel.SetContent(string(content))
+		m.reloaded = time.Now()
+		m.err = nil
+		return m, m.waitForChange()
+	case watchErrMsg:
+		log.Printf("Error watching slides: %v", msg.err)
+		m.err = fmt.Errorf("error watching slides: %v", msg.err)
+		return m, m.waitForChange()
+	}
+
+	var cmd tea.Cmd
+	m.slideModel, cmd = m.slideModel.Update(msg)
+	return m, cmd
+}
+
+func (m DevModel) View() string {
+	status := statusStyle.Render(fmt.Sprintf("Watching %s • reloaded at %s", m.path, m.reloaded.Format("15:04:05")))
+	if m.err != nil {
+		status = errorStyle.Render(fmt.Sprintf("Error: %v", m.err))
+	}
+
+	return appStyle.Render(lipgloss.JoinVertical(lipgloss.Left,
+		titleStyle.Render("Dev mode"),
+		status,
+		"\n",
+		m.slideModel.View(),
+		"\n",
+		subtle.Render("← → to navigate • q to quit"),
+	))
+}
+
+// RunDev shows the slides of the stage folder dir until the user quits, reloading them on every change
+func RunDev(dir string) error {
+	path, err := findSlides(dir)
+	if err != nil {
+		return err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	model, err := NewDevModel(path)
+	if err != nil {
+		return err
+	}
+	defer model.watcher.Close()
+
+	log.Printf("Watching slides in %s", path)
+	if _, err := tea.NewProgram(model, tea.WithAltScreen()).Run(); err != nil {
+		return fmt.Errorf("error running dev mode: %v", err)
+	}
+	return nil
+}
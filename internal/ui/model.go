@@ -1,9 +1,21 @@
 package ui
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
+	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/jlgore/nsfwctl/internal/git"
+	"github.com/jlgore/nsfwctl/internal/state"
+	"github.com/jlgore/nsfwctl/internal/terraform"
 )
 
 type ModelState int
@@ -12,23 +24,94 @@ const (
 	StateSelectingBranch ModelState = iota
 	StateViewingSlides
 	StateDeploymentOptions
+	StateDeploying
+	StateConfirmApply
+	StateDeployResult
+	StateConfirmDestroy
+	StatePrerequisites
+	StateHistory
+	StateSettings
 )
 
 type item struct {
+	branch      string
 	title       string
 	description string
 }
 
 func (i item) Title() string       { return i.title }
 func (i item) Description() string { return i.description }
-func (i item) FilterValue() string { return i.title }
+func (i item) FilterValue() string { return i.title + " " + i.description }
+
+// newBranchItem builds a list item for a stage, badging it with its manifest metadata,
+// whether it is deployed and whether it is new or updated since nsfwctl started
+func newBranchItem(info git.BranchInfo, deployed bool, change string) item {
+	badge := ""
+	if change != "" {
+		badge += fmt.Sprintf(" [%s]", change)
+	}
+	if deployed {
+		badge += " [deployed]"
+	}
+
+	manifest := info.Manifest
+	if manifest == nil {
+		return item{branch: info.Name, title: info.Name + badge, description: info.Description}
+	}
+
+	title := info.Name
+	if manifest.Title != "" {
+		title = fmt.Sprintf("%s (%s)", manifest.Title, info.Name)
+	}
+	if manifest.Order > 0 {
+		title = fmt.Sprintf("%d. %s", manifest.Order, title)
+	}
+	if manifest.Difficulty != "" {
+		title += fmt.Sprintf(" [%s]", manifest.Difficulty)
+	}
+	if manifest.EstimatedCost != "" {
+		title += fmt.Sprintf(" [%s]", manifest.EstimatedCost)
+	}
+	title += badge
+
+	description := info.Description
+	if len(manifest.Tags) > 0 {
+		tags := make([]string, len(manifest.Tags))
+		for i, tag := range manifest.Tags {
+			tags[i] = "#" + tag
+		}
+		description = strings.Join(tags, " ") + " · " + description
+	}
+
+	return item{branch: info.Name, title: title, description: description}
+}
 
 type Model struct {
 	list           list.Model
 	slideModel     SlideModel
+	viewport       viewport.Model
+	spinner        spinner.Model
+	confirmInput   textinput.Model
+	settings       settingsForm
 	repoPath       string
+	offlineBanner  string
+	changed        map[string]string // "new" or "updated" per branch, until it is opened
+	toast          string
+	toastID        int
+	stagePath      string
 	status         string
 	selectedBranch string
+	branches       []git.BranchInfo
+	deployed       map[string]state.Deployment
+	missingPrereqs []string
+	prereqErr      error // why the prerequisites couldn't be worked out
+	deployQueue    []string
+	lastPlan       *terraform.PlanSummary
+	deployStep     string
+	stepStarted    time.Time
+	logLines       []string
+	cancel         context.CancelFunc
+	teardown       bool
 	state          ModelState
 	err            error
 }
@@ -51,15 +134,68 @@ func NewModel(repoPath string) Model {
 	l.SetShowTitle(true)
 	l.SetFilteringEnabled(true)
 	l.Styles.Title = titleStyle
+	l.AdditionalShortHelpKeys = func() []key.Binding {
+		return []key.Binding{
+			key.NewBinding(key.WithKeys("H"), key.WithHelp("H", "history")),
+			key.NewBinding(key.WithKeys("S"), key.WithHelp("S", "settings")),
+		}
+	}
+
+	s := spinner.New()
+	s.Spinner = spinner.Dot
+	s.Style = statusStyle
+
+	ti := textinput.New()
+	ti.Placeholder = "branch name"
+	ti.CharLimit = 256
 
 	return Model{
-		list:     l,
-		repoPath: repoPath,
-		status:   "Initializing...",
-		state:    StateSelectingBranch,
+		list:         l,
+		viewport:     viewport.New(80, 20),
+		spinner:      s,
+		confirmInput: ti,
+		repoPath:     repoPath,
+		status:       "Initializing...",
+		state:        StateSelectingBranch,
 	}
 }
 
 func (m Model) Init() tea.Cmd {
-	return fetchBranchesWithDescriptionsCmd(m.repoPath)
+	return tea.Batch(fetchBranchesWithDescriptionsCmd(m.repoPath), loadDeploymentsCmd())
+}
+
+func (m Model) branchItems() []list.Item {
+	items := make([]list.Item, len(m.branches))
+	for i, branchInfo := range m.branches {
+		_, deployed := m.deployed[branchInfo.Name]
+		items[i] = newBranchItem(branchInfo, deployed, m.changed[branchInfo.Name])
+	}
+	return items
+}
+
+// refreshBranchItems rebuilds the branch list, keeping the selected branch selected
+func (m *Model) refreshBranchItems() {
+	selected, _ := m.list.SelectedItem().(item)
+	m.list.SetItems(m.branchItems())
+	for i, branchInfo := range m.branches {
+		if branchInfo.Name == selected.branch {
+			m.list.Select(i)
+			break
+		}
+	}
+}
+
+// missingPrerequisites returns the prerequisites of branch that aren't deployed, in deploy order
+func (m Model) missingPrerequisites(branch string) ([]string, error) {
+	chain, err := git.PrerequisiteChain(m.branches, branch)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, prereq := range chain {
+		if _, ok := m.deployed[prereq]; !ok {
+			missing = append(missing, prereq)
+		}
+	}
+	return missing, nil
 }
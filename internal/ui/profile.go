@@ -0,0 +1,100 @@
+package ui
+
+import (
+	"fmt"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/jlgore/nsfwctl/internal/config"
+)
+
+// profileItem is a curriculum profile in the picker; an empty name is the top-level settings
+type profileItem struct {
+	name    string
+	repoURL string
+}
+
+func (i profileItem) Title() string {
+	if i.name == "" {
+		return "default"
+	}
+	return i.name
+}
+func (i profileItem) Description() string { return i.repoURL }
+func (i profileItem) FilterValue() string { return i.Title() + " " + i.repoURL }
+
+// ProfilePicker lets the user choose a curriculum profile before the branch list is shown
+type ProfilePicker struct {
+	list     list.Model
+	selected *profileItem
+}
+
+// NewProfilePicker lists the configured profiles, preceded by the top-level settings
+func NewProfilePicker() ProfilePicker {
+	items := []list.Item{profileItem{repoURL: config.CurrentConfig.RepoURL}}
+	cfg := config.CurrentConfig
+	for _, name := range config.ProfileNames() {
+		repoURL := cfg.Profiles[name].RepoURL
+		if repoURL == "" {
+			repoURL = cfg.RepoURL
+		}
+		items = append(items, profileItem{name: name, repoURL: repoURL})
+	}
+
+	delegate := list.NewDefaultDelegate()
+	delegate.Styles.SelectedTitle = delegate.Styles.SelectedTitle.Foreground(lipgloss.Color("205"))
+	delegate.Styles.SelectedDesc = delegate.Styles.SelectedDesc.Foreground(lipgloss.Color("240"))
+
+	l := list.New(items, delegate, 20, 10)
+	l.Title = "Select a curriculum"
+	l.Styles.Title = titleStyle
+	return ProfilePicker{list: l}
+}
+
+func (m ProfilePicker) Init() tea.Cmd {
+	return nil
+}
+
+func (m ProfilePicker) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		h, v := appStyle.GetFrameSize()
+		m.list.SetSize(msg.Width-h, msg.Height-v)
+	case tea.KeyMsg:
+		if m.list.FilterState() == list.Filtering {
+			break
+		}
+		switch msg.String() {
+		case "ctrl+c", "q", "esc":
+			return m, tea.Quit
+		case "enter":
+			if i, ok := m.list.SelectedItem().(profileItem); ok {
+				m.selected = &i
+				return m, tea.Quit
+			}
+		}
+	}
+
+	var cmd tea.Cmd
+	m.list, cmd = m.list.Update(msg)
+	return m, cmd
+}
+
+func (m ProfilePicker) View() string {
+	return appStyle.Render(m.list.View())
+}
+
+// PickProfile runs the profile picker and returns the chosen profile name ("" for the
+// top-level settings). ok is false if the user quit without choosing.
+func PickProfile() (name string, ok bool, err error) {
+	final, err := tea.NewProgram(NewProfilePicker(), tea.WithAltScreen()).Run()
+	if err != nil {
+		return "", false, fmt.Errorf("error running profile picker: %v", err)
+	}
+	picker := final.(ProfilePicker)
+	if picker.selected == nil {
+		return "", false, nil
+	}
+	return picker.selected.name, true, nil
+}
@@ -0,0 +1,237 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/jlgore/nsfwctl/internal/config"
+	"github.com/jlgore/nsfwctl/internal/git"
+	"github.com/jlgore/nsfwctl/internal/terraform"
+)
+
+// settingsForm holds one text input per config setting
+type settingsForm struct {
+	keys     []string
+	inputs   []textinput.Model
+	original map[string]string
+	focus    int
+	problems map[string]string
+}
+
+type settingsInvalidMsg struct{ problems []config.Problem }
+type settingsSavedMsg struct{ cfg config.Config }
+
+// RepoChangedMsg is sent when saved settings moved the curriculum to another repository or
+// clone. Whoever runs the program restarts its background fetch for RepoPath.
+type RepoChangedMsg struct{ RepoPath string }
+
+// ApplySettings points the terraform package at the configured terraform binary and
+// gives the git package the offline mode and credentials for the curriculum repository
+func ApplySettings() {
+	cfg := config.CurrentConfig
+	terraform.SetBinaryOptions(terraform.BinaryOptions{
+		Path:    cfg.TerraformPath,
+		Version: cfg.TerraformVersion,
+		Archive: cfg.TerraformArchive,
+		Offline: cfg.Offline,
+	})
+	git.SetOffline(cfg.Offline)
+	git.SetAuthOptions(git.AuthOptions{
+		SSHKeyFile:       cfg.SSHKeyFile,
+		SSHKeyPassphrase: config.SSHKeyPassphrase(),
+		KnownHostsFile:   cfg.KnownHostsFile,
+		Token:            config.Token(),
+		CredentialHelper: cfg.CredentialHelper,
+	})
+}
+
+// newSettingsForm fills the form with the settings as stored in the config file
+func newSettingsForm() (settingsForm, error) {
+	cfg, err := config.EditableSettings()
+	if err != nil {
+		return settingsForm{}, err
+	}
+
+	f := settingsForm{
+		keys:     config.SettableKeys(),
+		original: make(map[string]string),
+		problems: make(map[string]string),
+	}
+	for _, key := range f.keys {
+		value, err := cfg.Get(key)
+		if err != nil {
+			return settingsForm{}, err
+		}
+		f.original[key] = value
+
+		ti := textinput.New()
+		ti.Prompt = ""
+		ti.CharLimit = 1024
+		ti.SetValue(value)
+		f.inputs = append(f.inputs, ti)
+	}
+	f.inputs[0].Focus()
+	return f, nil
+}
+
+// move shifts the focus by delta inputs, wrapping around
+func (f *settingsForm) move(delta int) {
+	f.inputs[f.focus].Blur()
+	f.focus = (f.focus + delta + len(f.inputs)) % len(f.inputs)
+	f.inputs[f.focus].Focus()
+}
+
+// changes returns the settings whose value was edited
+func (f settingsForm) changes() map[string]string {
+	changes := make(map[string]string)
+	for i, key := range f.keys {
+		if value := strings.TrimSpace(f.inputs[i].Value()); value != f.original[key] {
+			changes[key] = value
+		}
+	}
+	return changes
+}
+
+func (m Model) openSettings() (Model, tea.Cmd) {
+	form, err := newSettingsForm()
+	if err != nil {
+		m.err = err
+		return m, nil
+	}
+	m.settings = form
+	m.state = StateSettings
+	m.status = ""
+	m.err = nil
+	return m, textinput.Blink
+}
+
+func (m Model) updateSettings(msg tea.Msg) (Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch msg.String() {
+		case "esc":
+			m.state = StateSelectingBranch
+			m.err = nil
+			return m, nil
+		case "tab", "down", "enter":
+			m.settings.move(1)
+			return m, nil
+		case "shift+tab", "up":
+			m.settings.move(-1)
+			return m, nil
+		case "ctrl+s":
+			changes := m.settings.changes()
+			if len(changes) == 0 {
+				m.status = "No changes to save"
+				return m, nil
+			}
+			m.status = "Saving settings..."
+			m.settings.problems = make(map[string]string)
+			m.err = nil
+			return m, saveSettingsCmd(config.CurrentConfig.Profile, changes)
+		}
+	}
+
+	var cmd tea.Cmd
+	m.settings.inputs[m.settings.focus], cmd = m.settings.inputs[m.settings.focus].Update(msg)
+	return m, cmd
+}
+
+// saveSettingsCmd validates and saves the changed settings of profile. The resulting
+// configuration comes back in settingsSavedMsg; it only takes effect in Update.
+func saveSettingsCmd(profile string, changes map[string]string) tea.Cmd {
+	return func() tea.Msg {
+		cfg, err := config.UpdateSettings(profile, changes)
+		if err != nil {
+			if verr, ok := err.(*config.ValidationError); ok {
+				return settingsInvalidMsg{verr.Problems}
+			}
+			log.Printf("Error saving settings: %v", err)
+			return errMsg{err}
+		}
+		log.Printf("Saved settings %v", keysOf(changes))
+		return settingsSavedMsg{cfg}
+	}
+}
+
+// useSettings makes saved settings the current configuration. If they moved the curriculum
+// to another repository or clone, the command returned re-clones or re-fetches it.
+func (m Model) useSettings(cfg config.Config) (Model, tea.Cmd) {
+	before := config.CurrentConfig
+	beforeDir, _ := before.ClonePath()
+	config.CurrentConfig = cfg
+	ApplySettings()
+
+	m.state = StateSelectingBranch
+	cloneDir, err := cfg.ClonePath()
+	if err != nil {
+		m.err = err
+		return m, nil
+	}
+	if cfg.RepoURL == before.RepoURL && cfg.DefaultBranch == before.DefaultBranch && cloneDir == beforeDir {
+		m.status = "Settings saved"
+		return m, nil
+	}
+
+	m.status = "Settings saved, updating the repository..."
+	return m, func() tea.Msg {
+		repoPath, err := git.EnsureNsfwctlRepo(context.Background(), cfg.RepoURL, cfg.DefaultBranch, cloneDir)
+		if err != nil {
+			log.Printf("Failed to ensure repository: %v", err)
+			return errMsg{fmt.Errorf("settings saved, but the repository could not be updated: %v", err)}
+		}
+		return RepoChangedMsg{RepoPath: repoPath}
+	}
+}
+
+func keysOf(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+var settingsKeyStyle = lipgloss.NewStyle().Width(20)
+
+func (m Model) viewSettings() string {
+	title := "Settings"
+	if config.CurrentConfig.Profile != "" {
+		title = fmt.Sprintf("Settings (profile %s)", config.CurrentConfig.Profile)
+	}
+
+	lines := []string{subtle.Render(config.ConfigPath), ""}
+	for i, key := range m.settings.keys {
+		label := key
+		if i == m.settings.focus {
+			label = "> " + label
+		} else {
+			label = "  " + label
+		}
+		line := settingsKeyStyle.Render(label) + m.settings.inputs[i].View()
+		if source := config.OverrideSource(key); source != "" {
+			line += subtle.Render(fmt.Sprintf("  (overridden by %s)", source))
+		}
+		lines = append(lines, line)
+		if problem, ok := m.settings.problems[key]; ok {
+			lines = append(lines, errorStyle.Render(strings.Repeat(" ", 20)+problem))
+		}
+	}
+
+	header := statusStyle.Render(m.status)
+	if m.err != nil {
+		header = errorStyle.Render(fmt.Sprintf("Error: %v", m.err))
+	}
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		titleStyle.Render(title),
+		header,
+		strings.Join(lines, "\n"),
+		"\n",
+		subtle.Render("tab/↑ ↓ to move • ctrl+s to save • esc to cancel"),
+	)
+}
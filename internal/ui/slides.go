@@ -14,14 +14,10 @@ type SlideModel struct {
 	content      []string
 	currentSlide int
 	renderer     *glamour.TermRenderer
+	hint         string
 }
 
 func NewSlideModel(markdownContent string) (SlideModel, error) {
-	var slides []string
-	for _, slide := range strings.Split(markdownContent, "---") {
-		slides = append(slides, strings.TrimSpace(slide))
-	}
-
 	renderer, err := glamour.NewTermRenderer(
 		glamour.WithAutoStyle(),
 		glamour.WithWordWrap(80),
@@ -31,12 +27,29 @@ func NewSlideModel(markdownContent string) (SlideModel, error) {
 	}
 
 	return SlideModel{
-		content:      slides,
+		content:      splitSlides(markdownContent),
 		currentSlide: 0,
 		renderer:     renderer,
+		hint:         "(Use arrow keys to navigate, 'd' for deployment options)",
 	}, nil
 }
 
+func splitSlides(markdownContent string) []string {
+	var slides []string
+	for _, slide := range strings.Split(markdownContent, "---") {
+		slides = append(slides, strings.TrimSpace(slide))
+	}
+	return slides
+}
+
+// SetContent replaces the slides, staying on the current slide if it still exists
+func (m *SlideModel) SetContent(markdownContent string) {
+	m.content = splitSlides(markdownContent)
+	if m.currentSlide >= len(m.content) {
+		m.currentSlide = len(m.content) - 1
+	}
+}
+
 func (m SlideModel) Update(msg tea.Msg) (SlideModel, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
@@ -71,5 +84,5 @@ func (m SlideModel) View() string {
 
 	progress := progressStyle.Render(fmt.Sprintf("Slide %d of %d", m.currentSlide+1, len(m.content)))
 
-	return fmt.Sprintf("%s\n\n%s\n\n(Use arrow keys to navigate, 'd' for deployment options)", progress, renderedContent)
+	return fmt.Sprintf("%s\n\n%s\n\n%s", progress, renderedContent, m.hint)
 }
@@ -1,22 +1,138 @@
 package ui
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"strings"
 	"time"
 
 	"github.com/charmbracelet/bubbles/list"
+	"github.com/charmbracelet/bubbles/spinner"
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/jlgore/nsfwctl/internal/config"
 	"github.com/jlgore/nsfwctl/internal/git"
+	"github.com/jlgore/nsfwctl/internal/history"
+	"github.com/jlgore/nsfwctl/internal/state"
+	"github.com/jlgore/nsfwctl/internal/terraform"
+	"github.com/jlgore/nsfwctl/pkg/utils"
 )
 
 type fetchingMsg struct{}
 
+// CurriculumUpdatedMsg is sent into the running program when a background fetch finds
+// branches that are new, moved or gone in the clone in RepoPath
+type CurriculumUpdatedMsg struct {
+	RepoPath string
+	Changes  git.RefChanges
+}
+
+type toastExpiredMsg struct{ id int }
+
+const toastDuration = 5 * time.Second
+
 func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.WindowSizeMsg:
 		h, v := appStyle.GetFrameSize()
 		m.list.SetSize(msg.Width-h, msg.Height-v)
+		m.viewport.Width = msg.Width - h
+		m.viewport.Height = msg.Height - v - 6 // Leave room for the title, status and help lines
+
+	case spinner.TickMsg:
+		if m.state != StateDeploying {
+			return m, nil
+		}
+		var cmd tea.Cmd
+		m.spinner, cmd = m.spinner.Update(msg)
+		return m, cmd
+
+	case terraformInitMsg:
+		log.Printf("Terraform init finished for branch %s", m.selectedBranch)
+		if m.teardown {
+			return m.runStep("plan -destroy", "Running terraform destroy plan...", terraformDestroyPlanStep(m.stagePath))
+		}
+		return m.runStep("plan", "Running terraform plan...", terraformPlanStep(m.stagePath))
+
+	case terraformLogMsg:
+		m.logLines = append(m.logLines, msg.line)
+		if m.state == StateDeploying {
+			m.viewport.SetContent(strings.Join(m.logLines, "\n"))
+			m.viewport.GotoBottom()
+		}
+		return m, waitForLogLine(msg.lines)
+
+	case terraformPlanMsg:
+		m.state = StateConfirmApply
+		m.lastPlan = msg.summary
+		m.status = "Review the plan before applying"
+		m.viewport.SetContent(renderPlanSummary(msg.summary))
+		m.viewport.GotoTop()
+		return m, nil
+
+	case terraformApplyMsg:
+		if len(m.deployQueue) > 0 {
+			next := m.deployQueue[0]
+			m.deployQueue = m.deployQueue[1:]
+			log.Printf("Branch %s deployed, continuing with %s", m.selectedBranch, next)
+			m.logLines = append(m.logLines, "", fmt.Sprintf("Branch %s deployed, continuing with %s", m.selectedBranch, next))
+			var cmd tea.Cmd
+			m, cmd = m.startDeploy(next)
+			return m, tea.Batch(cmd, loadDeploymentsCmd())
+		}
+		m.state = StateDeployResult
+		m.status = fmt.Sprintf("Branch %s deployed successfully", m.selectedBranch)
+		m.viewport.SetContent(msg.output)
+		m.viewport.GotoTop()
+		return m, loadDeploymentsCmd()
+
+	case terraformDestroyPlanMsg:
+		m.state = StateConfirmDestroy
+		m.lastPlan = msg.summary
+		m.status = fmt.Sprintf("Type %q to confirm teardown", m.selectedBranch)
+		m.viewport.SetContent(renderPlanSummary(msg.summary))
+		m.viewport.GotoTop()
+		m.confirmInput.Reset()
+		return m, m.confirmInput.Focus()
+
+	case terraformDestroyMsg:
+		m.state = StateDeployResult
+		m.status = fmt.Sprintf("Branch %s torn down successfully", m.selectedBranch)
+		m.viewport.SetContent(msg.output)
+		m.viewport.GotoTop()
+		return m, loadDeploymentsCmd()
+
+	case terraformCancelledMsg:
+		m.err = fmt.Errorf("terraform %s cancelled after %s", msg.step, utils.FormatDuration(msg.elapsed))
+		m.deployQueue = nil
+		m.state = StateDeployResult
+		m.status = ""
+		m.logLines = append(m.logLines, "", fmt.Sprintf("terraform %s was interrupted before it finished.", msg.step))
+		if msg.step == "apply" || msg.step == "destroy" {
+			m.logLines = append(m.logLines, "Some resources may have been changed; run a plan again to see the current state.")
+		}
+		m.viewport.SetContent(strings.Join(m.logLines, "\n"))
+		m.viewport.GotoBottom()
+		return m, nil
+
+	case terraformErrMsg:
+		if msg.err == terraform.ErrStalePlan {
+			// Something changed the state since the plan was reviewed; review a new one
+			log.Printf("Plan of %s is stale, planning again", m.selectedBranch)
+			m.logLines = append(m.logLines, "", "The plan is stale: the state changed since it was made. Planning again.")
+			if m.teardown {
+				return m.runStep("plan -destroy", "Running terraform destroy plan...", terraformDestroyPlanStep(m.stagePath))
+			}
+			return m.runStep("plan", "Running terraform plan...", terraformPlanStep(m.stagePath))
+		}
+		m.err = fmt.Errorf("terraform %s failed: %v", msg.step, msg.err)
+		log.Printf("Error occurred: %v", m.err)
+		m.deployQueue = nil
+		m.state = StateDeployResult
+		m.status = ""
+		m.viewport.SetContent(strings.Join(append(m.logLines, "", msg.err.Error()), "\n"))
+		m.viewport.GotoBottom()
+		return m, nil
 
 	case fetchingMsg:
 		m.status = "Fetching branches" + strings.Repeat(".", int(time.Now().Unix()%4))
@@ -26,16 +142,77 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case fetchBranchesWithDescriptionsMsg:
 		m.status = ""
-		items := make([]list.Item, len(msg))
-		for i, branchInfo := range msg {
-			items[i] = item{title: branchInfo.Name, description: branchInfo.Description}
+		m.offlineBanner = git.OfflineBanner(m.repoPath)
+		m.branches = msg
+		m.refreshBranchItems()
+
+	case deploymentsMsg:
+		m.deployed = msg
+		m.refreshBranchItems()
+
+	case CurriculumUpdatedMsg:
+		if msg.RepoPath != m.repoPath {
+			return m, nil // A fetch of a clone from before the settings changed
+		}
+		if m.changed == nil {
+			m.changed = make(map[string]string)
 		}
-		m.list.SetItems(items)
+		for _, branch := range msg.Changes.Added {
+			m.changed[branch] = "new"
+		}
+		for _, branch := range msg.Changes.Updated {
+			if m.changed[branch] != "new" {
+				m.changed[branch] = "updated"
+			}
+		}
+		for _, branch := range msg.Changes.Removed {
+			delete(m.changed, branch)
+		}
+		m.toastID++
+		m.toast = fmt.Sprintf("Curriculum updated: %s", msg.Changes)
+		id := m.toastID
+		return m, tea.Batch(
+			fetchBranchesWithDescriptionsCmd(m.repoPath),
+			tea.Tick(toastDuration, func(time.Time) tea.Msg { return toastExpiredMsg{id} }),
+		)
+
+	case toastExpiredMsg:
+		if msg.id == m.toastID {
+			m.toast = ""
+		}
+		return m, nil
 
 	case slideModelMsg:
+		m.offlineBanner = git.OfflineBanner(m.repoPath)
 		m.slideModel = msg.model
+		m.stagePath = msg.stagePath
 		m.state = StateViewingSlides
 
+	case historyMsg:
+		m.state = StateHistory
+		m.viewport.SetContent(renderHistory(msg))
+		m.viewport.GotoTop()
+		return m, nil
+
+	case settingsInvalidMsg:
+		m.status = "Settings not saved"
+		for _, p := range msg.problems {
+			m.settings.problems[p.Key] = p.Message
+		}
+		return m, nil
+
+	case settingsSavedMsg:
+		return m.useSettings(msg.cfg)
+
+	case RepoChangedMsg:
+		log.Printf("Curriculum repository is now %s", msg.RepoPath)
+		m.repoPath = msg.RepoPath
+		m.branches = nil
+		m.list.SetItems(nil)
+		m.state = StateSelectingBranch
+		m.status = "Settings saved, fetching branches..."
+		return m, tea.Batch(fetchBranchesWithDescriptionsCmd(m.repoPath), loadDeploymentsCmd())
+
 	case errMsg:
 		m.err = msg.err
 		log.Printf("Error occurred: %v", m.err)
@@ -49,13 +226,28 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case StateSelectingBranch:
 		switch msg := msg.(type) {
 		case tea.KeyMsg:
+			if msg.String() == "H" && m.list.FilterState() != list.Filtering {
+				return m, loadHistoryCmd()
+			}
+			if msg.String() == "S" && m.list.FilterState() != list.Filtering {
+				return m.openSettings()
+			}
 			if msg.String() == "enter" {
 				i, ok := m.list.SelectedItem().(item)
 				if ok {
-					m.selectedBranch = i.title
+					m.selectedBranch = i.branch
+					if _, ok := m.changed[i.branch]; ok {
+						delete(m.changed, i.branch)
+						m.refreshBranchItems()
+					}
+					stagesDir, err := config.StagesDir()
+					if err != nil {
+						m.err = err
+						return m, nil
+					}
 					m.status = "Fetching slides..."
 					return m, tea.Batch(
-						fetchSlidesCmd(m.repoPath, m.selectedBranch),
+						fetchSlidesCmd(m.repoPath, stagesDir, m.selectedBranch),
 						func() tea.Msg { return statusMsg("Fetching slides...") },
 					)
 				}
@@ -75,6 +267,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			if msg.String() == "d" {
 				m.state = StateDeploymentOptions
+				m.status = ""
 				return m, nil
 			}
 		}
@@ -87,13 +280,144 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case tea.KeyMsg:
 			switch msg.String() {
 			case "1":
-				// Implement deployment logic here
+				missing, err := m.missingPrerequisites(m.selectedBranch)
+				if err != nil {
+					// Let the stage be deployed anyway, as --ignore-prerequisites does
+					log.Printf("Error checking prerequisites for %s: %v", m.selectedBranch, err)
+				}
+				m.missingPrereqs, m.prereqErr = missing, err
+				if err != nil || len(missing) > 0 {
+					m.state = StatePrerequisites
+					return m, nil
+				}
+				m.logLines = nil
+				m.deployQueue = nil
+				return m.startDeploy(m.selectedBranch)
+			case "2":
+				stagesDir, err := config.StagesDir()
+				if err != nil {
+					m.err = err
+					return m, nil
+				}
+				m.teardown = true
+				m.err = nil
+				m.logLines = nil
+				return m.runStep("init", "Running terraform init...", terraformInitStep(m.repoPath, stagesDir, m.selectedBranch))
+			case "3":
+				m.state = StateSelectingBranch
 				return m, nil
+			}
+		}
+
+	case StateDeploying:
+		switch msg := msg.(type) {
+		case tea.KeyMsg:
+			if (msg.String() == "ctrl+c" || msg.String() == "esc") && m.cancel != nil {
+				log.Printf("Interrupting terraform %s", m.deployStep)
+				m.cancel()
+				m.status = fmt.Sprintf("Interrupting terraform %s, waiting for it to save its state...", m.deployStep)
+				return m, nil
+			}
+		}
+		var cmd tea.Cmd
+		m.viewport, cmd = m.viewport.Update(msg)
+		return m, cmd
+
+	case StatePrerequisites:
+		switch msg := msg.(type) {
+		case tea.KeyMsg:
+			switch msg.String() {
+			case "1":
+				if m.prereqErr != nil {
+					return m, nil
+				}
+				// Deploy the missing stages in order, then the stage that was picked
+				log.Printf("Deploying prerequisites %v before %s", m.missingPrereqs, m.selectedBranch)
+				m.logLines = nil
+				m.deployQueue = append(append([]string{}, m.missingPrereqs[1:]...), m.selectedBranch)
+				return m.startDeploy(m.missingPrereqs[0])
 			case "2":
+				log.Printf("Deploying %s without prerequisites %v", m.selectedBranch, m.missingPrereqs)
+				m.logLines = nil
+				m.deployQueue = nil
+				return m.startDeploy(m.selectedBranch)
+			case "3", "esc":
+				m.state = StateDeploymentOptions
+				m.status = "Deployment cancelled"
+				return m, nil
+			}
+		}
+
+	case StateConfirmApply:
+		switch msg := msg.(type) {
+		case tea.KeyMsg:
+			switch msg.String() {
+			case "y":
+				return m.runStep("apply", "Running terraform apply...", terraformApplyStep(m.stagePath, m.selectedBranch, m.lastPlan.PlanFile))
+			case "n", "esc", "q":
+				m.state = StateDeploymentOptions
+				m.deployQueue = nil
+				m.status = "Apply cancelled"
+				return m, nil
+			}
+		}
+		var cmd tea.Cmd
+		m.viewport, cmd = m.viewport.Update(msg)
+		return m, cmd
+
+	case StateConfirmDestroy:
+		switch msg := msg.(type) {
+		case tea.KeyMsg:
+			switch msg.String() {
+			case "enter":
+				if m.confirmInput.Value() != m.selectedBranch {
+					m.status = fmt.Sprintf("Confirmation did not match; type %q to confirm teardown", m.selectedBranch)
+					return m, nil
+				}
+				m.confirmInput.Blur()
+				return m.runStep("destroy", "Running terraform destroy...", terraformDestroyStep(m.stagePath, m.selectedBranch, m.lastPlan.PlanFile))
+			case "esc":
+				m.confirmInput.Blur()
+				m.state = StateDeploymentOptions
+				m.status = "Teardown cancelled"
+				return m, nil
+			case "up", "down", "pgup", "pgdown":
+				var cmd tea.Cmd
+				m.viewport, cmd = m.viewport.Update(msg)
+				return m, cmd
+			}
+		}
+		var cmd tea.Cmd
+		m.confirmInput, cmd = m.confirmInput.Update(msg)
+		return m, cmd
+
+	case StateHistory:
+		switch msg := msg.(type) {
+		case tea.KeyMsg:
+			if msg.String() == "q" || msg.String() == "esc" {
 				m.state = StateSelectingBranch
 				return m, nil
 			}
 		}
+		var cmd tea.Cmd
+		m.viewport, cmd = m.viewport.Update(msg)
+		return m, cmd
+
+	case StateSettings:
+		return m.updateSettings(msg)
+
+	case StateDeployResult:
+		switch msg := msg.(type) {
+		case tea.KeyMsg:
+			if msg.String() == "q" || msg.String() == "esc" {
+				m.state = StateDeploymentOptions
+				m.err = nil
+				return m, nil
+			}
+		}
+		var cmd tea.Cmd
+		m.viewport, cmd = m.viewport.Update(msg)
+		return m, cmd
 	}
 
 	return m, nil
@@ -104,7 +428,7 @@ type statusMsg string
 func fetchBranchesWithDescriptionsCmd(repoPath string) tea.Cmd {
 	return func() tea.Msg {
 		log.Printf("Executing fetchBranchesWithDescriptionsCmd for repo: %s", repoPath)
-		branchInfos, err := git.FetchBranchesWithDescriptions(repoPath)
+		branchInfos, err := git.FetchBranchesWithDescriptions(context.Background(), repoPath)
 		if err != nil {
 			log.Printf("Error fetching branches: %v", err)
 			return errMsg{err}
@@ -114,22 +438,48 @@ func fetchBranchesWithDescriptionsCmd(repoPath string) tea.Cmd {
 	}
 }
 
-func fetchSlidesCmd(repoPath, branchName string) tea.Cmd {
+func fetchSlidesCmd(repoPath, stagesDir, branchName string) tea.Cmd {
 	return func() tea.Msg {
-		content, err := git.FetchSlides(repoPath, branchName)
+		content, err := git.FetchSlides(context.Background(), repoPath, branchName)
 		if err != nil {
 			return errMsg{err}
 		}
+		stagePath := git.StageWorktreePath(stagesDir, branchName)
 		slideModel, err := NewSlideModel(content)
 		if err != nil {
 			return errMsg{err}
 		}
-		return slideModelMsg{slideModel}
+		return slideModelMsg{model: slideModel, stagePath: stagePath}
+	}
+}
+
+func loadDeploymentsCmd() tea.Cmd {
+	return func() tea.Msg {
+		deployed, err := state.Deployed()
+		if err != nil {
+			log.Printf("Error loading deployed stages: %v", err)
+			return errMsg{err}
+		}
+		return deploymentsMsg(deployed)
+	}
+}
+
+func loadHistoryCmd() tea.Cmd {
+	return func() tea.Msg {
+		entries, err := history.Load()
+		if err != nil {
+			log.Printf("Error loading history: %v", err)
+			return errMsg{err}
+		}
+		return historyMsg(entries)
 	}
 }
 
 type fetchBranchesWithDescriptionsMsg []git.BranchInfo
+type historyMsg []history.Entry
+type deploymentsMsg map[string]state.Deployment
 type slideModelMsg struct {
-	model SlideModel
+	model     SlideModel
+	stagePath string
 }
 type errMsg struct{ err error }
@@ -3,8 +3,11 @@ package ui
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/lipgloss"
+	"github.com/jlgore/nsfwctl/internal/history"
+	"github.com/jlgore/nsfwctl/pkg/utils"
 )
 
 func (m Model) View() string {
@@ -15,6 +18,20 @@ func (m Model) View() string {
 		return m.viewSlides()
 	case StateDeploymentOptions:
 		return m.viewDeploymentOptions()
+	case StateDeploying:
+		return m.viewDeploying()
+	case StateConfirmApply:
+		return m.viewConfirmApply()
+	case StateDeployResult:
+		return m.viewDeployResult()
+	case StateConfirmDestroy:
+		return m.viewConfirmDestroy()
+	case StatePrerequisites:
+		return m.viewPrerequisites()
+	case StateHistory:
+		return m.viewHistory()
+	case StateSettings:
+		return m.viewSettings()
 	default:
 		return "Unknown state"
 	}
@@ -23,7 +40,13 @@ func (m Model) View() string {
 func (m Model) viewBranchSelection() string {
 	title := titleStyle.Render("nsfwctl")
 	repoInfo := fmt.Sprintf("Repository: %s", m.repoPath)
+	if m.offlineBanner != "" {
+		repoInfo += "\n" + offlineStyle.Render(m.offlineBanner)
+	}
 	statusInfo := statusStyle.Render(m.status)
+	if m.toast != "" {
+		statusInfo = toastStyle.Render(m.toast)
+	}
 	listView := m.list.View()
 
 	if m.err != nil {
@@ -57,6 +80,9 @@ func (m Model) viewSlides() string {
 	}
 
 	title := titleStyle.Render(fmt.Sprintf("Slides for branch: %s", m.selectedBranch))
+	if m.offlineBanner != "" {
+		title += "  " + offlineStyle.Render(m.offlineBanner)
+	}
 	slideContent := m.slideModel.View()
 	navigationHelp := subtle.Render("← → to navigate • q to quit • d for deployment options")
 
@@ -73,21 +99,157 @@ func (m Model) viewDeploymentOptions() string {
 	title := titleStyle.Render("Deployment Options")
 	options := []string{
 		"1. Deploy this branch",
-		"2. Return to branch selection",
+		"2. Tear down this stage",
+		"3. Return to branch selection",
 	}
 	optionsView := strings.Join(options, "\n")
 
 	return lipgloss.JoinVertical(lipgloss.Left,
 		title,
+		statusStyle.Render(m.status),
 		"\n",
 		optionsView,
 		"\n",
-		subtle.Render("Enter your choice (1 or 2)"),
+		subtle.Render("Enter your choice (1, 2 or 3)"),
+	)
+}
+
+func (m Model) viewPrerequisites() string {
+	if m.prereqErr != nil {
+		return lipgloss.JoinVertical(lipgloss.Left,
+			titleStyle.Render(fmt.Sprintf("Can't check prerequisites for: %s", m.selectedBranch)),
+			"\n",
+			errorStyle.Render(m.prereqErr.Error()),
+			"\n",
+			"2. Deploy this stage anyway\n3. Cancel",
+			"\n",
+			subtle.Render("Enter your choice (2 or 3)"),
+		)
+	}
+
+	title := titleStyle.Render(fmt.Sprintf("Missing prerequisites for: %s", m.selectedBranch))
+	warning := errorStyle.Render("This stage builds on stages that aren't deployed yet:")
+
+	var chain []string
+	for i, prereq := range m.missingPrereqs {
+		chain = append(chain, fmt.Sprintf("  %d. %s", i+1, prereq))
+	}
+
+	options := []string{
+		"1. Deploy the missing stages in order, then this one",
+		"2. Deploy this stage anyway",
+		"3. Cancel",
+	}
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		title,
+		"\n",
+		warning,
+		strings.Join(chain, "\n"),
+		"\n",
+		strings.Join(options, "\n"),
+		"\n",
+		subtle.Render("Enter your choice (1, 2 or 3)"),
+	)
+}
+
+func (m Model) viewDeploying() string {
+	action := "Deploying"
+	if m.teardown {
+		action = "Tearing down"
+	}
+	title := titleStyle.Render(fmt.Sprintf("%s branch: %s", action, m.selectedBranch))
+	progress := fmt.Sprintf("%s %s", m.spinner.View(), statusStyle.Render(m.status))
+	elapsed := utils.FormatDuration(time.Since(m.stepStarted))
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		title,
+		progress,
+		m.viewport.View(),
+		subtle.Render(fmt.Sprintf("Step: terraform %s • elapsed %s • esc to cancel", m.deployStep, elapsed)),
+		subtle.Render(m.queueInfo()),
+	)
+}
+
+func (m Model) viewConfirmApply() string {
+	title := titleStyle.Render(fmt.Sprintf("Plan for branch: %s", m.selectedBranch))
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		title,
+		statusStyle.Render(m.status),
+		m.viewport.View(),
+		subtle.Render(fmt.Sprintf("%3.f%% • ↑ ↓ to scroll • y to apply • n to cancel", m.viewport.ScrollPercent()*100)),
+		subtle.Render(m.queueInfo()),
+	)
+}
+
+func (m Model) viewConfirmDestroy() string {
+	title := titleStyle.Render(fmt.Sprintf("Destroy plan for branch: %s", m.selectedBranch))
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		title,
+		errorStyle.Render(m.status),
+		m.viewport.View(),
+		m.confirmInput.View(),
+		subtle.Render(fmt.Sprintf("%3.f%% • ↑ ↓ to scroll • enter to destroy • esc to cancel", m.viewport.ScrollPercent()*100)),
+	)
+}
+
+func (m Model) viewDeployResult() string {
+	title := titleStyle.Render(fmt.Sprintf("Deployment of branch: %s", m.selectedBranch))
+	header := statusStyle.Render(m.status)
+	if m.err != nil {
+		header = errorStyle.Render(fmt.Sprintf("Error: %v", m.err))
+	}
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		title,
+		header,
+		m.viewport.View(),
+		subtle.Render(fmt.Sprintf("%3.f%% • ↑ ↓ to scroll • q to return to deployment options", m.viewport.ScrollPercent()*100)),
 	)
 }
 
 var (
-	subtle      = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
-	errorStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
-	statusStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("12"))
+	subtle       = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+	errorStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+	statusStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("12"))
+	offlineStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("11")).Bold(true)
+	toastStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("#FFFDF5")).Background(lipgloss.Color("#25A065")).Padding(0, 1)
 )
+
+func (m Model) viewHistory() string {
+	title := titleStyle.Render("Deployment history")
+
+	return lipgloss.JoinVertical(lipgloss.Left,
+		title,
+		"\n",
+		m.viewport.View(),
+		subtle.Render(fmt.Sprintf("%3.f%% • ↑ ↓ to scroll • q to return to branch selection", m.viewport.ScrollPercent()*100)),
+	)
+}
+
+// renderHistory lists ledger entries, newest first, colouring failures and cancellations
+func renderHistory(entries []history.Entry) string {
+	if len(entries) == 0 {
+		return "Nothing has been deployed yet."
+	}
+
+	lines := make([]string, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		line := entries[i].String()
+		if entries[i].Outcome != history.OutcomeSuccess {
+			line = errorStyle.Render(line)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// queueInfo describes the stages still waiting to be deployed after the current one
+func (m Model) queueInfo() string {
+	if len(m.deployQueue) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Queued next: %s", strings.Join(m.deployQueue, " → "))
+}
@@ -104,3 +104,29 @@ func IsValidBranchName(name string) bool {
 	}
 	return true
 }
+
+// LocalRepoPath returns the absolute directory a repository URL points at when it is a
+// file:// URL or a local path (absolute, ./relative, ../relative or ~/), and false otherwise
+func LocalRepoPath(repoURL string) (string, bool) {
+	path := repoURL
+	switch {
+	case strings.HasPrefix(repoURL, "file://"):
+		path = strings.TrimPrefix(repoURL, "file://")
+	case repoURL == "~" || strings.HasPrefix(repoURL, "~/"):
+		home, err := GetHomeDir()
+		if err != nil {
+			return "", false
+		}
+		path = filepath.Join(home, strings.TrimPrefix(repoURL, "~"))
+	case filepath.IsAbs(repoURL), repoURL == ".", repoURL == "..",
+		strings.HasPrefix(repoURL, "./"), strings.HasPrefix(repoURL, "../"):
+	default:
+		return "", false
+	}
+
+	abs, err := filepath.Abs(filepath.FromSlash(path))
+	if err != nil {
+		return "", false
+	}
+	return abs, true
+}